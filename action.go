@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"time"
 )
 
 //----------------------------------------------------------------------------
@@ -63,7 +64,8 @@ func (a *action) delete_line(line *line, v *view) {
 	} else {
 		v.buf.first_line = ai
 	}
-	line.data = line.data[:0]
+	// the contents are kept by the action, let the memory go
+	line.data = nil
 }
 
 func (a *action) insert(v *view) {
@@ -133,19 +135,19 @@ func (a *action) do(v *view, what action_type) {
 		v.buf.other_views(v, func(v *view) {
 			v.on_insert(a)
 		})
-		if v.buf.is_mark_set() {
-			v.buf.mark.on_insert_adjust(a)
-		}
 	case action_delete:
 		a.delete(v)
 		v.on_delete_adjust_top_line(a)
 		v.buf.other_views(v, func(v *view) {
 			v.on_delete(a)
 		})
-		if v.buf.is_mark_set() {
-			v.buf.mark.on_delete_adjust(a)
-		}
 	}
+	v.buf.adjust_marks(a, what)
+	v.buf.adjust_cursors(a, what)
+	if v.ctx.jumps != nil {
+		v.ctx.jumps.adjust(v.buf, a, what)
+	}
+	v.ctx.registers.adjust(v.buf, a, what)
 	v.dirty = dirty_everything
 
 	// any change to the buffer causes words cache invalidation
@@ -219,14 +221,27 @@ func (a *action) try_merge(b *action) bool {
 
 //----------------------------------------------------------------------------
 // action group
+//
+// Action groups form a tree: undoing a few groups and making a change starts
+// a new branch, the old one is kept in 'children' of the parent. 'next' points
+// to the branch redo follows, it's the most recently visited one. At the tip
+// of the history 'next' may also point to an empty group, which is not a part
+// of the tree yet.
 //----------------------------------------------------------------------------
 
+const (
+	line_memory_cost         = 48
+	action_group_memory_cost = 128
+)
+
 type action_group struct {
-	actions []action
-	next    *action_group
-	prev    *action_group
-	before  cursor_location
-	after   cursor_location
+	actions  []action
+	next     *action_group
+	prev     *action_group
+	children []*action_group
+	before   cursor_location
+	after    cursor_location
+	time     time.Time
 }
 
 func (ag *action_group) append(a *action) {
@@ -241,6 +256,20 @@ func (ag *action_group) append(a *action) {
 	ag.actions = append(ag.actions, *a)
 }
 
+// Rough estimate of the memory held by the action, it's additive, merged
+// actions cost exactly as much as their parts.
+func (a *action) memory_cost() int {
+	return len(a.data) + len(a.lines)*line_memory_cost
+}
+
+func (ag *action_group) memory_cost() int {
+	cost := action_group_memory_cost
+	for i := range ag.actions {
+		cost += ag.actions[i].memory_cost()
+	}
+	return cost
+}
+
 // Valid only as long as no new actions were added to the action group.
 func (ag *action_group) last_action() *action {
 	if len(ag.actions) == 0 {
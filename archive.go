@@ -0,0 +1,382 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	termbox "github.com/nsf/termbox-go"
+)
+
+//----------------------------------------------------------------------------
+// archives
+//
+// Opening a tar or zip archive gives a read-only listing of its members,
+// <enter> opens the member under the cursor. Paths of member buffers point
+// inside the archive ("/path/to/archive.zip/dir/file"), reading and writing
+// such paths goes to the archive member, writing rewrites the whole archive.
+//----------------------------------------------------------------------------
+
+const (
+	archive_none   = ""
+	archive_zip    = "zip"
+	archive_tar    = "tar"
+	archive_tar_gz = "tar.gz"
+)
+
+func archive_kind(path string) string {
+	lower := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return archive_zip
+	case strings.HasSuffix(lower, ".tar"):
+		return archive_tar
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return archive_tar_gz
+	}
+	return archive_none
+}
+
+// Splits a path pointing inside an archive into the archive path and the
+// member name.
+func split_archive_path(path string) (archive, name string, ok bool) {
+	dir := path
+	for {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", false
+		}
+		if archive_kind(parent) != archive_none {
+			fi, err := os.Stat(parent)
+			if err == nil && fi.Mode().IsRegular() {
+				return parent, filepath.ToSlash(path[len(parent)+1:]), true
+			}
+		}
+		dir = parent
+	}
+}
+
+// tar members are often stored as "./name"
+func archive_member_name(name string) string {
+	return strings.TrimPrefix(name, "./")
+}
+
+// The file on disk which holds the contents of 'path'.
+func disk_path(path string) string {
+	if archive, _, ok := split_archive_path(path); ok {
+		return archive
+	}
+	return path
+}
+
+type archive_entry struct {
+	name  string
+	size  int64
+	mode  os.FileMode
+	mtime time.Time
+}
+
+// Calls 'cb' for every tar entry, 'cb' may read the entry data from 'r'.
+func walk_tar(archive string, cb func(hdr *tar.Header, r io.Reader) error) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if archive_kind(archive) == archive_tar_gz {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := cb(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func list_archive(archive string) ([]archive_entry, error) {
+	var entries []archive_entry
+	if archive_kind(archive) == archive_zip {
+		zr, err := zip.OpenReader(archive)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			entries = append(entries, archive_entry{
+				name:  f.Name,
+				size:  int64(f.UncompressedSize64),
+				mode:  f.Mode(),
+				mtime: f.Modified,
+			})
+		}
+		return entries, nil
+	}
+
+	err := walk_tar(archive, func(hdr *tar.Header, r io.Reader) error {
+		entries = append(entries, archive_entry{
+			name:  hdr.Name,
+			size:  hdr.Size,
+			mode:  hdr.FileInfo().Mode(),
+			mtime: hdr.ModTime,
+		})
+		return nil
+	})
+	return entries, err
+}
+
+func read_archive_member(archive, name string) ([]byte, error) {
+	var data []byte
+	found := false
+	if archive_kind(archive) == archive_zip {
+		zr, err := zip.OpenReader(archive)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			if f.Name != name {
+				continue
+			}
+			r, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			return ioutil.ReadAll(r)
+		}
+	} else {
+		err := walk_tar(archive, func(hdr *tar.Header, r io.Reader) error {
+			if found || archive_member_name(hdr.Name) != name {
+				return nil
+			}
+			found = true
+			var err error
+			data, err = ioutil.ReadAll(r)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !found {
+		return nil, os.ErrNotExist
+	}
+	return data, nil
+}
+
+// Rewrites the archive with the member 'name' replaced by 'data', a member
+// which is not there yet is appended.
+func write_archive_member(archive, name string, data []byte) error {
+	var out bytes.Buffer
+	var err error
+	if archive_kind(archive) == archive_zip {
+		err = rewrite_zip(&out, archive, name, data)
+	} else {
+		err = rewrite_tar(&out, archive, name, data)
+	}
+	if err != nil {
+		return err
+	}
+	return atomic_write_file(archive, out.Bytes())
+}
+
+func rewrite_zip(out io.Writer, archive, name string, data []byte) error {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	zw := zip.NewWriter(out)
+	if err := zw.SetComment(zr.Comment); err != nil {
+		return err
+	}
+	write := func(hdr *zip.FileHeader) error {
+		hdr.Modified = time.Now()
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+
+	found := false
+	for _, f := range zr.File {
+		if f.Name != name {
+			if err := zw.Copy(f); err != nil {
+				return err
+			}
+			continue
+		}
+		found = true
+		hdr := &zip.FileHeader{
+			Name:    f.Name,
+			Comment: f.Comment,
+			Method:  f.Method,
+		}
+		hdr.SetMode(f.Mode())
+		if err := write(hdr); err != nil {
+			return err
+		}
+	}
+	if !found {
+		hdr := &zip.FileHeader{Name: name, Method: zip.Deflate}
+		hdr.SetMode(0644)
+		if err := write(hdr); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func rewrite_tar(out io.Writer, archive, name string, data []byte) error {
+	var gz *gzip.Writer
+	if archive_kind(archive) == archive_tar_gz {
+		gz = gzip.NewWriter(out)
+		out = gz
+	}
+	tw := tar.NewWriter(out)
+
+	found := false
+	err := walk_tar(archive, func(hdr *tar.Header, r io.Reader) error {
+		if archive_member_name(hdr.Name) != name || found {
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			_, err := io.Copy(tw, r)
+			return err
+		}
+		found = true
+		hdr.Size = int64(len(data))
+		hdr.ModTime = time.Now()
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(data)),
+			ModTime:  time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if gz != nil {
+		return gz.Close()
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------
+// archive listing buffer
+//----------------------------------------------------------------------------
+
+// lines before the first entry in the listing
+const archive_listing_header = 1
+
+func archive_listing(archive string) ([]byte, []archive_entry, error) {
+	entries, err := list_archive(archive)
+	if err != nil {
+		return nil, nil, err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Archive %s (%d entries):\n", archive, len(entries))
+	for _, e := range entries {
+		fmt.Fprintf(&buf, "  %s %10d %s  %s\n",
+			e.mode, e.size, e.mtime.Format("2006-01-02 15:04"), e.name)
+	}
+	return buf.Bytes(), entries, nil
+}
+
+func (g *godit) new_archive_buffer(archive string) (*buffer, error) {
+	text, entries, err := archive_listing(archive)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := new_buffer(bytes.NewReader(text))
+	if err != nil {
+		return nil, err
+	}
+	buf.path = archive
+	buf.readonly = true
+	if fi, err := os.Stat(archive); err == nil {
+		buf.stamp = make_file_stamp(fi)
+	}
+
+	buf.keymap = func(v *view, ev *termbox.Event) bool {
+		switch {
+		case ev.Key == termbox.KeyEnter || ev.Key == termbox.KeyCtrlJ:
+			n := v.cursor.line_num - archive_listing_header - 1
+			if n < 0 || n >= len(entries) {
+				return true
+			}
+			e := entries[n]
+			if e.mode.IsDir() {
+				g.set_status("%s is a directory", e.name)
+				return true
+			}
+			mbuf, err := g.new_buffer_from_file(archive + "/" + archive_member_name(e.name))
+			if err != nil {
+				return true
+			}
+			v.attach(mbuf)
+			return true
+		case ev.Ch == 'g' && ev.Mod == 0:
+			text, new_entries, err := archive_listing(archive)
+			if err != nil {
+				g.set_status("%s", err)
+				return true
+			}
+			entries = new_entries
+			v.replace_contents(text)
+			buf.on_disk = buf.history
+			if fi, err := os.Stat(archive); err == nil {
+				buf.stamp = make_file_stamp(fi)
+			}
+			g.set_status("Archive listing refreshed")
+			return true
+		}
+		return false
+	}
+	g.set_status("(Archive: <enter> to open a member, g to refresh)")
+	return buf, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import "archive/tar"
+import "archive/zip"
+import "bytes"
+import "compress/gzip"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+
+func TestArchiveMembers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	members := map[string]string{
+		"conf/app.ini": "[app]\nname = test\n",
+		"README":       "readme\n",
+	}
+	var zbuf, tbuf bytes.Buffer
+	zw := zip.NewWriter(&zbuf)
+	gz := gzip.NewWriter(&tbuf)
+	tw := tar.NewWriter(gz)
+	for _, name := range []string{"conf/app.ini", "README"} {
+		w, _ := zw.Create(name)
+		w.Write([]byte(members[name]))
+		tw.WriteHeader(&tar.Header{
+			Name:     "./" + name,
+			Typeflag: tar.TypeReg,
+			Mode:     0600,
+			Size:     int64(len(members[name])),
+		})
+		tw.Write([]byte(members[name]))
+	}
+	zw.Close()
+	tw.Close()
+	gz.Close()
+
+	for name, data := range map[string][]byte{
+		"release.zip":    zbuf.Bytes(),
+		"release.tar.gz": tbuf.Bytes(),
+	} {
+		archive := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(archive, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := list_archive(archive)
+		if err != nil || len(entries) != 2 {
+			t.Fatalf("%s: listed %d entries, %v", name, len(entries), err)
+		}
+
+		path := filepath.Join(archive, "conf", "app.ini")
+		a, member, ok := split_archive_path(path)
+		if !ok || a != archive || member != "conf/app.ini" {
+			t.Fatalf("%s: split into %q, %q", name, a, member)
+		}
+		if got, err := read_archive_member(a, member); err != nil || string(got) != members[member] {
+			t.Errorf("%s: read %q, %v", name, got, err)
+		}
+
+		if err := write_archive_member(a, member, []byte("changed\n")); err != nil {
+			t.Fatal(err)
+		}
+		if err := write_archive_member(a, "new.txt", []byte("new\n")); err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]string{
+			"conf/app.ini": "changed\n",
+			"README":       "readme\n",
+			"new.txt":      "new\n",
+		}
+		for member, data := range expected {
+			got, err := read_archive_member(a, member)
+			if err != nil || string(got) != data {
+				t.Errorf("%s: %s is %q after rewriting, %v", name, member, got, err)
+			}
+		}
+	}
+}
@@ -377,7 +377,9 @@ func gocode_ac(view *view) ([]ac_proposal, int) {
 	var out bytes.Buffer
 	gocode := exec.Command("gocode", "-f=godit", "autocomplete",
 		view.buf.path, strconv.Itoa(cursor_ex.abs_boffset))
-	gocode.Stdin = view.buf.reader()
+	// 'abs_boffset' counts line endings as '\n', the reader would give
+	// gocode the ones of the file
+	gocode.Stdin = bytes.NewReader(view.buf.joined_lines())
 	gocode.Stdout = &out
 
 	err := gocode.Run()
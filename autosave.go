@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	termbox "github.com/nsf/termbox-go"
+)
+
+//----------------------------------------------------------------------------
+// autosave
+//
+// Modified buffers are periodically written to the cache directory when the
+// user stops typing for a while. The copy is removed on a successful save
+// and offered for recovery when the file is opened next time.
+//----------------------------------------------------------------------------
+
+const autosave_idle_time = 5 * time.Second
+
+func autosave_dir() string {
+	return cache_dir("autosave")
+}
+
+// Returns the name of the autosave file for a given file path, the path is
+// escaped so that it fits into a single file name.
+func autosave_path(path string) string {
+	name := url.PathEscape(path)
+	if len(name) > 200 {
+		sum := sha1.Sum([]byte(path))
+		name = filepath.Base(path) + "-" + hex.EncodeToString(sum[:])
+	}
+	return filepath.Join(autosave_dir(), name)
+}
+
+// Special buffers (like directory listings) are not autosaved.
+func (b *buffer) needs_autosave() bool {
+	return b.path != "" && b.keymap == nil && !b.synced_with_disk() &&
+		b.autosaved != b.history
+}
+
+func (b *buffer) autosave() error {
+	if err := os.MkdirAll(autosave_dir(), 0700); err != nil {
+		return err
+	}
+	data, err := b.file_contents()
+	if err != nil {
+		return err
+	}
+	err = atomic_write_file(autosave_path(b.path), data)
+	if err != nil {
+		return err
+	}
+	b.autosaved = b.history
+	return nil
+}
+
+func (b *buffer) remove_autosave() {
+	if b.path == "" {
+		return
+	}
+	os.Remove(autosave_path(b.path))
+	b.autosaved = nil
+}
+
+// Returns true if there is an autosave file for the buffer and it is newer
+// than the file itself.
+func (b *buffer) has_newer_autosave() bool {
+	if b.path == "" {
+		return false
+	}
+	fi, err := os.Stat(autosave_path(b.path))
+	if err != nil {
+		return false
+	}
+	return fi.ModTime().After(b.stamp.mtime)
+}
+
+// Called from the main loop when there was no input for 'autosave_idle_time'.
+func (g *godit) autosave_buffers() {
+	for _, buf := range g.buffers {
+		if !buf.needs_autosave() {
+			continue
+		}
+		if err := buf.autosave(); err != nil {
+			g.set_status("Autosave of %s failed: %s", buf.name, err)
+		}
+	}
+}
+
+// Asks whether the buffers queued in 'g.recovery_queue' should be recovered
+// from their autosave files, one at a time. While the question is asked, the
+// active view shows the difference between the file and the autosave data.
+func (g *godit) offer_recovery() {
+	if g.overlay != nil {
+		return
+	}
+	for len(g.recovery_queue) > 0 {
+		buf := g.recovery_queue[0]
+		g.recovery_queue = g.recovery_queue[1:]
+
+		name := autosave_path(buf.path)
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		text, enc, eol := decode_file_contents(data)
+		diff := unified_diff(buf.path, name,
+			decode_eol(buf.contents(), buf.eol), text)
+		if diff == nil {
+			// nothing to recover
+			os.Remove(name)
+			continue
+		}
+
+		diffbuf, _ := new_buffer(bytes.NewReader(diff))
+		diffbuf.name = g.buffer_name("*autosave diff*")
+		g.buffers = append(g.buffers, diffbuf)
+		g.active.leaf.attach(diffbuf)
+
+		finish := func() {
+			g.kill_buffer(diffbuf)
+			g.active.leaf.attach(buf)
+
+			// ask about the next one when this prompt is gone
+			g.asyncFns <- g.offer_recovery
+		}
+		g.set_overlay_mode(init_key_press_mode(
+			g,
+			map[rune]func(){
+				'y': func() {
+					finish()
+					buf.set_eol(eol)
+					buf.encoding = enc
+					g.with_view(buf, func(v *view) {
+						v.replace_contents(text)
+					})
+					g.set_status("Recovered %s from autosave, save it to keep the changes", buf.name)
+				},
+				'n': func() {
+					finish()
+				},
+				'd': func() {
+					finish()
+					os.Remove(name)
+					g.set_status("Autosave data of %s discarded", buf.name)
+				},
+			},
+			0,
+			"Autosave data of "+buf.name+" is newer; recover it? (y, n or d to discard)",
+		))
+		return
+	}
+}
+
+// Writes the buffer to a recovery file, buffers visiting a file go to their
+// usual autosave location, so that they're offered for recovery next time.
+// Returns the name of the recovery file.
+func (b *buffer) dump_for_recovery() (name string, err error) {
+	// the buffer may be in a broken state after a panic
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	if b.path != "" {
+		return autosave_path(b.path), b.autosave()
+	}
+
+	if err := os.MkdirAll(autosave_dir(), 0700); err != nil {
+		return "", err
+	}
+	name = filepath.Join(autosave_dir(), url.PathEscape(
+		"unnamed-"+strconv.Itoa(os.Getpid())+"-"+b.name))
+	data, err := b.file_contents()
+	if err != nil {
+		// better something than nothing
+		data = b.contents()
+	}
+	return name, atomic_write_file(name, data)
+}
+
+// The last resort on a panic or a fatal signal: restores the terminal, dumps
+// all unsaved buffers to recovery files, tells where they went and exits.
+func (g *godit) emergency_exit(reason string) {
+	set_bracketed_paste(false)
+	termbox.Close()
+	fmt.Fprintln(os.Stderr, reason)
+	for _, buf := range g.buffers {
+		if buf.synced_with_disk() {
+			continue
+		}
+		name, err := buf.dump_for_recovery()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to save %s: %s\n", buf.name, err)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "Saved %s to %s\n", buf.name, name)
+	}
+	os.Exit(2)
+}
+
+// Deferred by whatever runs with the terminal set up, a panic ends in
+// 'emergency_exit'.
+func (g *godit) recover_panic() {
+	if r := recover(); r != nil {
+		g.emergency_exit(fmt.Sprintf("panic: %v\n\n%s", r, debug.Stack()))
+	}
+}
+
+// Opens the files the way 'new_godit' does, a panic on the way leaves the
+// terminal usable. Nothing is modified at that point, so nothing is dumped.
+func start_godit(filenames []string) *godit {
+	defer new(godit).recover_panic()
+	return new_godit(filenames)
+}
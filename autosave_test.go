@@ -0,0 +1,44 @@
+package main
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+func TestDumpForRecovery(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	path := filepath.Join(t.TempDir(), "a.txt")
+	ioutil.WriteFile(path, []byte("one\n"), 0644)
+	old := time.Now().Add(-time.Minute)
+	os.Chtimes(path, old, old)
+
+	g := new_godit([]string{path})
+	v := g.active.leaf
+	v.action_insert(v.cursor, []byte("zero\n"))
+	name, err := v.buf.dump_for_recovery()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != autosave_path(v.buf.path) {
+		t.Errorf("dumped to %s, not to the autosave file", name)
+	}
+	if data, err := ioutil.ReadFile(name); err != nil || string(data) != "zero\none\n" {
+		t.Errorf("autosave file has %q, %v", data, err)
+	}
+	if !v.buf.has_newer_autosave() {
+		t.Error("the dump is not offered for recovery")
+	}
+
+	// buffers without a file get a file of their own
+	scratch := new_test_view("")
+	scratch.buf.name = "unnamed"
+	scratch.action_insert(scratch.cursor, []byte("scratch"))
+	name, err = scratch.buf.dump_for_recovery()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(name); err != nil || string(data) != "scratch" {
+		t.Errorf("%s has %q, %v", name, data, err)
+	}
+}
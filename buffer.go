@@ -2,11 +2,16 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"unicode/utf8"
+	"sort"
+	"time"
+
+	termbox "github.com/nsf/termbox-go"
 )
 
 //----------------------------------------------------------------------------
@@ -24,7 +29,7 @@ func (l *line) find_closest_offsets(voffset int) (bo, co, vo int) {
 	data := l.data
 	for len(data) > 0 {
 		var vodif int
-		r, rlen := utf8.DecodeRune(data)
+		r, rlen := decode_rune(data)
 		data = data[rlen:]
 		vodif = rune_advance_len(r, vo)
 		if vo+vodif > voffset {
@@ -38,6 +43,77 @@ func (l *line) find_closest_offsets(voffset int) (bo, co, vo int) {
 	return
 }
 
+//----------------------------------------------------------------------------
+// file stamp
+//
+// Identity of the on-disk file at the moment it was loaded or saved. It is
+// used to detect modifications made by other programs.
+//----------------------------------------------------------------------------
+
+type file_stamp struct {
+	mtime time.Time
+	size  int64
+}
+
+func make_file_stamp(fi os.FileInfo) file_stamp {
+	return file_stamp{
+		mtime: fi.ModTime(),
+		size:  fi.Size(),
+	}
+}
+
+func (s file_stamp) matches(fi os.FileInfo) bool {
+	return s.mtime.Equal(fi.ModTime()) && s.size == fi.Size()
+}
+
+//----------------------------------------------------------------------------
+// line endings
+//
+// Internally lines are always separated by '\n', the line ending convention
+// of a file is detected when it's loaded and restored when it's written.
+//----------------------------------------------------------------------------
+
+var (
+	eol_lf   = []byte("\n")
+	eol_crlf = []byte("\r\n")
+	eol_cr   = []byte("\r")
+)
+
+// CRLF is used only if every '\n' is preceded by '\r', CR only if there are
+// no '\n' at all. Mixed files are left as they are, stray '\r' characters
+// stay visible.
+func detect_eol(data []byte) []byte {
+	lf := bytes.Count(data, eol_lf)
+	if lf == 0 {
+		if bytes.IndexByte(data, '\r') != -1 {
+			return eol_cr
+		}
+		return eol_lf
+	}
+	if bytes.Count(data, eol_crlf) == lf {
+		return eol_crlf
+	}
+	return eol_lf
+}
+
+// Converts 'data' with 'eol' line endings to '\n' line endings.
+func decode_eol(data, eol []byte) []byte {
+	if bytes.Equal(eol, eol_lf) {
+		return data
+	}
+	return bytes.Replace(data, eol, eol_lf, -1)
+}
+
+func eol_name(eol []byte) string {
+	switch {
+	case bytes.Equal(eol, eol_crlf):
+		return "CRLF"
+	case bytes.Equal(eol, eol_cr):
+		return "CR"
+	}
+	return "LF"
+}
+
 //----------------------------------------------------------------------------
 // buffer
 //----------------------------------------------------------------------------
@@ -51,12 +127,38 @@ type buffer struct {
 	bytes_n    int
 	history    *action_group
 	on_disk    *action_group
+	autosaved  *action_group
 	mark       cursor_location
+	mark_ring  []cursor_location
+
+	// estimated memory held by the undo history and the budget for it,
+	// when the history doesn't fit, its oldest parts are dropped
+	history_size      int
+	undo_limit        int
+	history_truncated bool
 
 	// absoulte path of the file, if it's empty string, then the file has no
 	// on-disk representation
 	path string
 
+	// state of the file on disk after the last load or save, zero if the
+	// file was never read or written
+	stamp file_stamp
+
+	// line ending convention and encoding used when the buffer is written
+	// out
+	eol      []byte
+	encoding string
+
+	// compression of the file, see 'codec_for_path'
+	codec string
+
+	// special buffers (like archive listings) can't be edited and handle
+	// some of the keys themselves, 'keymap' returns true if it handled the
+	// key
+	readonly bool
+	keymap   func(v *view, ev *termbox.Event) bool
+
 	// buffer name (displayed in the status line), must be unique,
 	// uniqueness is maintained by godit methods
 	name string
@@ -82,17 +184,23 @@ func new_empty_buffer() *buffer {
 			line_num: 1,
 		},
 	}
+	b.eol = eol_lf
+	b.encoding = enc_utf8
 	b.init_history()
 	return b
 }
 
 func new_buffer(r io.Reader) (*buffer, error) {
-	var err error
 	var prevline *line
 
-	br := bufio.NewReader(r)
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
 	l := new(line)
 	b := new(buffer)
+	data, b.encoding, b.eol = decode_file_contents(data)
+	br := bufio.NewReader(bytes.NewReader(data))
 	b.loc = view_location{
 		top_line:     l,
 		top_line_num: 1,
@@ -123,6 +231,7 @@ func new_buffer(r io.Reader) (*buffer, error) {
 	}
 	l.prev = prevline
 	b.last_line = l
+	b.bytes_n += len(l.data)
 
 	// io.EOF is not an error
 	if err == io.EOF {
@@ -174,6 +283,103 @@ func (b *buffer) init_history() {
 	first.prev = sentinel
 	b.history = sentinel
 	b.on_disk = sentinel
+	b.history_size = 0
+	b.history_truncated = false
+	b.undo_limit = *undo_limit << 20
+}
+
+// Drops the oldest parts of the undo history until it fits into the memory
+// budget. Branches that don't lead to the current state or to its redo chain
+// go first, oldest first, then the oldest groups on the way to the current
+// state. The current group is always kept. If the saved state goes away, the
+// buffer can't be in sync with the disk anymore. Returns true if something
+// was dropped.
+func (b *buffer) trim_history() bool {
+	if b.undo_limit <= 0 || b.history_size <= b.undo_limit {
+		return false
+	}
+
+	root := b.history
+	main := make(map[*action_group]bool)
+	for ag := b.history; ag != nil; ag = ag.prev {
+		main[ag] = true
+		root = ag
+	}
+	for ag := b.history.next; ag != nil && len(ag.actions) != 0; ag = ag.next {
+		main[ag] = true
+	}
+
+	var side []*action_group
+	for ag := range main {
+		for _, child := range ag.children {
+			if !main[child] {
+				side = append(side, child)
+			}
+		}
+	}
+	sort.Slice(side, func(i, j int) bool {
+		return side[i].time.Before(side[j].time)
+	})
+
+	dropped := false
+	for _, ag := range side {
+		if b.history_size <= b.undo_limit {
+			break
+		}
+		b.drop_history_branch(ag)
+		dropped = true
+	}
+
+	// the group after the root becomes the new root, the state after it
+	// is the oldest one that can be reached
+	for b.history_size > b.undo_limit && root != b.history && root.next != b.history {
+		next := root.next
+		for _, child := range root.children {
+			if child != next {
+				b.drop_history_branch(child)
+			}
+		}
+		b.forget_history_group(root)
+		b.history_size -= next.memory_cost()
+		next.actions = nil
+		next.prev = nil
+		root = next
+		dropped = true
+	}
+
+	if dropped {
+		b.history_truncated = true
+	}
+	return dropped
+}
+
+// Drops 'ag' and everything that grows from it.
+func (b *buffer) drop_history_branch(ag *action_group) {
+	parent := ag.prev
+	for i, child := range parent.children {
+		if child == ag {
+			parent.children = append(parent.children[:i], parent.children[i+1:]...)
+			break
+		}
+	}
+	var drop func(ag *action_group)
+	drop = func(ag *action_group) {
+		for _, child := range ag.children {
+			drop(child)
+		}
+		b.forget_history_group(ag)
+		b.history_size -= ag.memory_cost()
+	}
+	drop(ag)
+}
+
+func (b *buffer) forget_history_group(ag *action_group) {
+	if b.on_disk == ag {
+		b.on_disk = nil
+	}
+	if b.autosaved == ag {
+		b.autosaved = nil
+	}
 }
 
 func (b *buffer) is_mark_set() bool {
@@ -212,23 +418,65 @@ func (b *buffer) save() error {
 	return b.save_as(b.path)
 }
 
+var err_readonly_buffer = errors.New("Buffer is read-only")
+
+// Returned by 'save_as' when the file was written, but its undo history
+// wasn't.
+type undo_history_error struct {
+	err error
+}
+
+func (e *undo_history_error) Error() string {
+	return "Undo history not saved: " + e.err.Error()
+}
+
 func (b *buffer) save_as(filename string) error {
-	r := b.reader()
-	f, err := os.Create(filename)
+	if b.readonly {
+		return err_readonly_buffer
+	}
+	if fi, err := os.Stat(filename); err == nil && fi.IsDir() {
+		return fmt.Errorf("%s is a directory", filename)
+	}
+	data, err := b.file_contents()
+	if err != nil {
+		return err
+	}
+
+	// files which were never read or written get compressed according to
+	// their name, the others stay the way they were
+	codec := b.codec
+	if filename != b.path || b.stamp.mtime.IsZero() {
+		codec = codec_for_path(filename)
+	}
+	data, err = compress(codec, data)
+	if err != nil {
+		return err
+	}
+	if archive, name, ok := split_archive_path(filename); ok {
+		err = write_archive_member(archive, name, data)
+	} else {
+		err = atomic_write_file(filename, data)
+	}
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	_, err = io.Copy(f, r)
+	fi, err := os.Stat(disk_path(filename))
 	if err != nil {
 		return err
 	}
 
+	b.remove_autosave()
+	undo_err := b.save_undo_history(filename, data)
+	b.codec = codec
 	b.on_disk = b.history
+	b.stamp = make_file_stamp(fi)
 	for _, v := range b.views {
 		v.dirty |= dirty_status
 	}
+	if undo_err != nil {
+		return &undo_history_error{undo_err}
+	}
 	return nil
 }
 
@@ -236,6 +484,34 @@ func (b *buffer) synced_with_disk() bool {
 	return b.on_disk == b.history
 }
 
+// Returns true if the file was modified (or removed) by someone else since
+// the buffer was loaded or saved last time.
+func (b *buffer) changed_on_disk() bool {
+	if b.path == "" || b.stamp.mtime.IsZero() {
+		return false
+	}
+
+	fi, err := os.Stat(disk_path(b.path))
+	if err != nil {
+		return true
+	}
+	return !b.stamp.matches(fi)
+}
+
+// Switches the buffer to a different line ending convention, the buffer
+// becomes modified, as it no longer matches the file on disk.
+func (b *buffer) set_eol(eol []byte) bool {
+	if bytes.Equal(b.eol, eol) {
+		return false
+	}
+	b.eol = eol
+	b.on_disk = nil
+	for _, v := range b.views {
+		v.dirty |= dirty_status
+	}
+	return true
+}
+
 func (b *buffer) reader() *buffer_reader {
 	return new_buffer_reader(b)
 }
@@ -245,6 +521,15 @@ func (b *buffer) contents() []byte {
 	return data
 }
 
+func (b *buffer) is_binary() bool {
+	return b.encoding == enc_binary
+}
+
+// Contents of the buffer the way they go to the file, in its encoding.
+func (b *buffer) file_contents() ([]byte, error) {
+	return encode_text(b.contents(), b.encoding)
+}
+
 func (b *buffer) refill_words_cache() {
 	b.words_cache.clear()
 	line := b.first_line
@@ -272,7 +557,7 @@ func (b *buffer) update_words_cache() {
 type buffer_reader struct {
 	buffer *buffer
 	line   *line
-	offset int
+	offset int // may point past the line data, into its line ending
 }
 
 func new_buffer_reader(buffer *buffer) *buffer_reader {
@@ -290,24 +575,25 @@ func (br *buffer_reader) Read(data []byte) (int, error) {
 			return nread, io.EOF
 		}
 
-		// how much can we read from current line
-		can_read := len(br.line.data) - br.offset
-		if len(data) <= can_read {
-			// if this is all we need, return
+		// read what's left of the current line
+		if br.offset < len(br.line.data) {
 			n := copy(data, br.line.data[br.offset:])
 			nread += n
 			br.offset += n
-			break
+			data = data[n:]
+			continue
 		}
 
-		// otherwise try to read '\n' and jump to the next line
-		n := copy(data, br.line.data[br.offset:])
-		nread += n
-		data = data[n:]
-		if len(data) > 0 && br.line != br.buffer.last_line {
-			data[0] = '\n'
-			data = data[1:]
-			nread++
+		// then its line ending, unless it's the last line
+		if br.line != br.buffer.last_line {
+			eol := br.buffer.eol[br.offset-len(br.line.data):]
+			if len(eol) > 0 {
+				n := copy(data, eol)
+				nread += n
+				br.offset += n
+				data = data[n:]
+				continue
+			}
 		}
 
 		br.line = br.line.next
@@ -0,0 +1,90 @@
+package main
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+import "testing/iotest"
+import "time"
+import termbox "github.com/nsf/termbox-go"
+
+func TestLineEndings(t *testing.T) {
+	tests := []struct {
+		data string
+		eol  string
+	}{
+		{"one\ntwo\n", "LF"},
+		{"one\r\ntwo\r\nthree", "CRLF"},
+		{"one\rtwo\r", "CR"},
+		{"one\r\ntwo\n", "LF"},
+		{"", "LF"},
+	}
+	for _, test := range tests {
+		buf, err := new_buffer(strings.NewReader(test.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name := eol_name(buf.eol); name != test.eol {
+			t.Errorf("%q detected as %s, expected %s", test.data, name, test.eol)
+		}
+		if test.eol != "LF" && strings.ContainsRune(string(buf.first_line.data), '\r') {
+			t.Errorf("%q: line ending left in the line data", test.data)
+		}
+
+		// small reads must not break the line endings
+		data, err := ioutil.ReadAll(iotest.OneByteReader(buf.reader()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != test.data {
+			t.Errorf("%q was written back as %q", test.data, data)
+		}
+	}
+}
+
+func TestRevert(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	path := filepath.Join(t.TempDir(), "a.txt")
+	ioutil.WriteFile(path, []byte("one\n"), 0644)
+	old := time.Now().Add(-time.Minute)
+	os.Chtimes(path, old, old)
+
+	g := new_godit([]string{path})
+	v := g.active.leaf
+	b := v.buf
+	if b.changed_on_disk() {
+		t.Fatal("changed on disk right after opening")
+	}
+	ioutil.WriteFile(path, []byte("two\n"), 0644)
+	if !b.changed_on_disk() {
+		t.Fatal("the change on disk is not noticed")
+	}
+
+	// saving asks first, "n" leaves the file alone
+	v.on_vcommand(vcommand_insert_rune, 'x')
+	g.save_active_buffer(false)
+	if g.overlay == nil {
+		t.Fatal("saved over the changed file without asking")
+	}
+	g.overlay.on_key(&termbox.Event{Type: termbox.EventKey, Ch: 'n'})
+	if data, _ := ioutil.ReadFile(path); string(data) != "two\n" {
+		t.Fatalf("file has %q", data)
+	}
+
+	if err := g.revert_buffer(b); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b.contents()); got != "two\n" {
+		t.Fatalf("reverted to %q", got)
+	}
+	if b.changed_on_disk() || !b.synced_with_disk() {
+		t.Fatal("the buffer doesn't match the file after revert")
+	}
+
+	// one undo brings back what was there before the revert
+	v.on_vcommand(vcommand_undo, 0)
+	if got := string(b.contents()); got != "xone\n" {
+		t.Fatalf("undoing the revert gave %q", got)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+//----------------------------------------------------------------------------
+// system clipboard
+//
+// Every change of the most recent kill ring entry is copied to the system
+// clipboard. The default backend is the OSC 52 escape sequence, which is
+// handled by the terminal, so it works over SSH and inside tmux as well.
+// 'wl-copy' and 'xclip' can be used instead with '-clipboard'. A terminal
+// can't be asked for the clipboard contents reliably, so pasting always goes
+// through 'wl-paste' or 'xclip'.
+//----------------------------------------------------------------------------
+
+const (
+	clipboard_osc52  = "osc52"
+	clipboard_wl     = "wl-copy"
+	clipboard_xclip  = "xclip"
+	clipboard_none   = "none"
+	osc52_max_length = 100000 // many terminals ignore longer sequences
+)
+
+func osc52_sequence(data []byte) []byte {
+	var buf bytes.Buffer
+	inside_tmux := os.Getenv("TMUX") != ""
+	if inside_tmux {
+		// tmux passes the sequence to the outer terminal when it's wrapped
+		// like this, escape characters inside are doubled
+		buf.WriteString("\x1bPtmux;\x1b")
+	}
+	buf.WriteString("\x1b]52;c;")
+	buf.WriteString(base64.StdEncoding.EncodeToString(data))
+	buf.WriteString("\x07")
+	if inside_tmux {
+		buf.WriteString("\x1b\\")
+	}
+	return buf.Bytes()
+}
+
+func write_to_terminal(data []byte) error {
+	tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+	if err != nil {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	defer tty.Close()
+	_, err = tty.Write(data)
+	return err
+}
+
+func run_with_input(data []byte, name string, args ...string) error {
+	if _, err := exec.LookPath(name); err != nil {
+		return fmt.Errorf("the %s program is not installed", name)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %s", name, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func (g *godit) copy_to_clipboard(data []byte) {
+	switch *clipboard_backend {
+	case clipboard_osc52:
+		if len(data) > osc52_max_length {
+			g.set_status("The kill is too long for the clipboard (OSC 52)")
+			return
+		}
+		if err := write_to_terminal(osc52_sequence(data)); err != nil {
+			g.set_status("%s", err)
+		}
+	case clipboard_wl, clipboard_xclip:
+		name, args := clipboard_wl, []string(nil)
+		if *clipboard_backend == clipboard_xclip {
+			name, args = clipboard_xclip, []string{"-selection", "clipboard"}
+		}
+		data = clone_byte_slice(data)
+		go func() {
+			// both programs keep running in the background to serve
+			// the clipboard, don't wait for them
+			if err := run_with_input(data, name, args...); err != nil {
+				g.asyncFns <- func() {
+					g.set_status("%s", err)
+				}
+			}
+		}()
+	}
+}
+
+func read_clipboard() ([]byte, error) {
+	type paste_cmd struct {
+		name string
+		args []string
+		env  string
+	}
+	cmds := []paste_cmd{
+		{"wl-paste", []string{"--no-newline"}, "WAYLAND_DISPLAY"},
+		{"xclip", []string{"-o", "-selection", "clipboard"}, "DISPLAY"},
+	}
+	switch *clipboard_backend {
+	case clipboard_wl:
+		cmds = cmds[:1]
+	case clipboard_xclip:
+		cmds = cmds[1:]
+	}
+	for _, c := range cmds {
+		if _, err := exec.LookPath(c.name); err != nil {
+			continue
+		}
+		if len(cmds) > 1 && os.Getenv(c.env) == "" {
+			continue
+		}
+		out, err := exec.Command(c.name, c.args...).Output()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", c.name, err)
+		}
+		return out, nil
+	}
+	return nil, errors.New("reading the clipboard needs wl-paste or xclip")
+}
+
+// Puts the clipboard contents to the kill ring and yanks it.
+func (g *godit) yank_from_clipboard() {
+	v := g.active.leaf
+	data, err := read_clipboard()
+	if err != nil {
+		g.set_status("%s", err)
+		return
+	}
+	if len(data) == 0 {
+		g.set_status("The clipboard is empty")
+		return
+	}
+	if !bytes.Equal(g.kill_ring.head(), data) {
+		g.kill_ring.push(data)
+	}
+	v.on_vcommand(vcommand_yank, 0)
+}
@@ -0,0 +1,14 @@
+package main
+
+import "testing"
+
+func TestOSC52(t *testing.T) {
+	t.Setenv("TMUX", "")
+	if got := string(osc52_sequence([]byte("hi"))); got != "\x1b]52;c;aGk=\x07" {
+		t.Fatalf("OSC 52 sequence is %q", got)
+	}
+	t.Setenv("TMUX", "/tmp/tmux-1000/default,1,0")
+	if got := string(osc52_sequence([]byte("hi"))); got != "\x1bPtmux;\x1b\x1b]52;c;aGk=\x07\x1b\\" {
+		t.Fatalf("OSC 52 sequence for tmux is %q", got)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+//----------------------------------------------------------------------------
+// compressed files
+//
+// Files with a known compression suffix are decompressed when they're loaded
+// and compressed back when they're written. The suffix alone is not enough,
+// the data must also start with the right magic, otherwise the file is taken
+// as it is. bzip2 is read-only, zstd needs the 'zstd' binary.
+//----------------------------------------------------------------------------
+
+const (
+	codec_none  = ""
+	codec_gzip  = "gzip"
+	codec_bzip2 = "bzip2"
+	codec_zstd  = "zstd"
+)
+
+var codec_magic = map[string][]byte{
+	codec_gzip:  {0x1F, 0x8B},
+	codec_bzip2: []byte("BZh"),
+	codec_zstd:  {0x28, 0xB5, 0x2F, 0xFD},
+}
+
+// Compression used for a newly written file, judging by its name.
+func codec_for_path(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gz":
+		return codec_gzip
+	case ".bz2":
+		return codec_bzip2
+	case ".zst":
+		return codec_zstd
+	}
+	return codec_none
+}
+
+// Compression of the file contents 'data' read from 'path'.
+func detect_codec(path string, data []byte) string {
+	codec := codec_for_path(path)
+	if codec == codec_none || !bytes.HasPrefix(data, codec_magic[codec]) {
+		return codec_none
+	}
+	return codec
+}
+
+func decompress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case codec_gzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case codec_bzip2:
+		return ioutil.ReadAll(bzip2.NewReader(bytes.NewReader(data)))
+	case codec_zstd:
+		return run_zstd(data, "-d")
+	}
+	return data, nil
+}
+
+func compress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case codec_gzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case codec_bzip2:
+		return nil, errors.New("writing bzip2 files is not supported, save it under a different name")
+	case codec_zstd:
+		return run_zstd(data)
+	}
+	return data, nil
+}
+
+func run_zstd(data []byte, args ...string) ([]byte, error) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		return nil, errors.New("zstd files need the zstd program, which is not installed")
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("zstd", append(args, "-c", "-q")...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("zstd: %s", strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// Reads a file or an archive member, decompressing it if needed. Returns the
+// raw data as well, since it's used for the undo history hash.
+func read_file_contents(path string) (data, raw []byte, codec string, err error) {
+	if archive, name, ok := split_archive_path(path); ok {
+		raw, err = read_archive_member(archive, name)
+	} else {
+		raw, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, nil, codec_none, err
+	}
+	codec = detect_codec(path, raw)
+	data, err = decompress(codec, raw)
+	if err != nil {
+		return nil, nil, codec, fmt.Errorf("%s: %s", filepath.Base(path), err)
+	}
+	return data, raw, codec, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import "bytes"
+import "io/ioutil"
+import "path/filepath"
+import "testing"
+
+func TestCompressedFiles(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", dir)
+
+	contents := []byte("log line 1\nlog line 2\n")
+	gz, err := compress(codec_gzip, contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "app.log.gz")
+	if err := ioutil.WriteFile(path, gz, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	data, raw, codec, err := read_file_contents(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codec != codec_gzip || !bytes.Equal(data, contents) || !bytes.Equal(raw, gz) {
+		t.Fatalf("unexpected result: %s, %q", codec, data)
+	}
+
+	// written back compressed
+	g := new_godit([]string{path})
+	v := g.active.leaf
+	if v.buf.codec != codec_gzip || v.buf.changed_on_disk() {
+		t.Fatalf("opened as %s, changed on disk: %v", v.buf.codec, v.buf.changed_on_disk())
+	}
+	v.on_vcommand(vcommand_insert_rune, '#')
+	if err := v.buf.save(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _, codec, err := read_file_contents(path); err != nil ||
+		codec != codec_gzip || string(data) != "#"+string(contents) {
+		t.Errorf("saved file reads back as %s, %q, %v", codec, data, err)
+	}
+	if v.buf.changed_on_disk() || !v.buf.synced_with_disk() {
+		t.Errorf("buffer doesn't match the file after the save")
+	}
+
+	// the name alone is not enough
+	if codec := detect_codec("plain.gz", contents); codec != codec_none {
+		t.Errorf("uncompressed data detected as %s", codec)
+	}
+	if _, err := compress(codec_bzip2, contents); err == nil {
+		t.Errorf("bzip2 files must be read-only")
+	}
+}
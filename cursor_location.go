@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	"unicode/utf8"
 )
 
 //----------------------------------------------------------------------------
@@ -16,11 +15,11 @@ type cursor_location struct {
 }
 
 func (c *cursor_location) rune_under() (rune, int) {
-	return utf8.DecodeRune(c.line.data[c.boffset:])
+	return decode_rune(c.line.data[c.boffset:])
 }
 
 func (c *cursor_location) rune_before() (rune, int) {
-	return utf8.DecodeLastRune(c.line.data[:c.boffset])
+	return decode_last_rune(c.line.data[:c.boffset])
 }
 
 func (c *cursor_location) first_line() bool {
@@ -66,7 +65,7 @@ func (a cursor_location) distance(b cursor_location) int {
 func (c *cursor_location) voffset_coffset() (vo, co int) {
 	data := c.line.data[:c.boffset]
 	for len(data) > 0 {
-		r, rlen := utf8.DecodeRune(data)
+		r, rlen := decode_rune(data)
 		data = data[rlen:]
 		co += 1
 		vo += rune_advance_len(r, vo)
@@ -78,7 +77,7 @@ func (c *cursor_location) voffset_coffset() (vo, co int) {
 func (c *cursor_location) voffset() (vo int) {
 	data := c.line.data[:c.boffset]
 	for len(data) > 0 {
-		r, rlen := utf8.DecodeRune(data)
+		r, rlen := decode_rune(data)
 		data = data[rlen:]
 		vo += rune_advance_len(r, vo)
 	}
@@ -88,7 +87,7 @@ func (c *cursor_location) voffset() (vo int) {
 func (c *cursor_location) coffset() (co int) {
 	data := c.line.data[:c.boffset]
 	for len(data) > 0 {
-		_, rlen := utf8.DecodeRune(data)
+		_, rlen := decode_rune(data)
 		data = data[rlen:]
 		co += 1
 	}
@@ -153,7 +152,7 @@ func (c *cursor_location) move_one_rune_backward() {
 
 func (c *cursor_location) move_n_bytes_forward(buf []byte) {
 	for len(buf) > 0 {
-		_, rlen := utf8.DecodeRune(buf)
+		_, rlen := decode_rune(buf)
 		buf = buf[rlen:]
 		c.move_one_rune_forward()
 	}
@@ -170,7 +169,7 @@ func (c *cursor_location) move_end_of_line() {
 func (c *cursor_location) word_under_cursor() []byte {
 	end, beg := *c, *c
 	r, rlen := beg.rune_before()
-	if r == utf8.RuneError {
+	if rlen == 0 {
 		return nil
 	}
 
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+//----------------------------------------------------------------------------
+// line diff
+//
+// A straightforward implementation of the Myers' O(ND) algorithm, used to show
+// differences between two versions of a file. If the files differ too much,
+// the diff degrades to "remove everything, add everything".
+//----------------------------------------------------------------------------
+
+const (
+	diff_context_lines = 3
+	diff_max_edits     = 2000
+)
+
+type diff_op struct {
+	kind byte // ' ', '-' or '+'
+	line []byte
+}
+
+func split_lines_keep_eol(data []byte) [][]byte {
+	lines := bytes.SplitAfter(data, []byte{'\n'})
+	if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func diff_lines(a, b [][]byte) []diff_op {
+	ops := make([]diff_op, 0, len(a)+len(b))
+
+	// common prefix and suffix are cheap to find and usually make the
+	// actual diff problem a lot smaller
+	pre := 0
+	for pre < len(a) && pre < len(b) && bytes.Equal(a[pre], b[pre]) {
+		ops = append(ops, diff_op{' ', a[pre]})
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre &&
+		bytes.Equal(a[len(a)-1-suf], b[len(b)-1-suf]) {
+		suf++
+	}
+
+	ops = append(ops, diff_myers(a[pre:len(a)-suf], b[pre:len(b)-suf])...)
+	for _, l := range a[len(a)-suf:] {
+		ops = append(ops, diff_op{' ', l})
+	}
+	return ops
+}
+
+func diff_myers(a, b [][]byte) []diff_op {
+	n, m := len(a), len(b)
+	max := n + m
+	off := max + 1
+	v := make([]int, 2*max+3)
+
+	// trace[d] holds 'v' for diagonals [-d-1, d+1] before the step 'd'
+	var trace [][]int
+	for d := 0; d <= max && d <= diff_max_edits; d++ {
+		trace = append(trace, append([]int(nil), v[off-d-1:off+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && bytes.Equal(a[x], b[y]) {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				return diff_backtrack(a, b, trace)
+			}
+		}
+	}
+
+	// too many differences, replace everything
+	ops := make([]diff_op, 0, n+m)
+	for _, l := range a {
+		ops = append(ops, diff_op{'-', l})
+	}
+	for _, l := range b {
+		ops = append(ops, diff_op{'+', l})
+	}
+	return ops
+}
+
+func diff_backtrack(a, b [][]byte, trace [][]int) []diff_op {
+	var rops []diff_op
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		at := func(k int) int { return v[k+d+1] }
+
+		k := x - y
+		var pk int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			pk = k + 1
+		} else {
+			pk = k - 1
+		}
+		px := at(pk)
+		py := px - pk
+		for x > px && y > py {
+			rops = append(rops, diff_op{' ', a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == px {
+				rops = append(rops, diff_op{'+', b[y-1]})
+			} else {
+				rops = append(rops, diff_op{'-', a[x-1]})
+			}
+		}
+		x, y = px, py
+	}
+
+	ops := make([]diff_op, len(rops))
+	for i, op := range rops {
+		ops[len(rops)-1-i] = op
+	}
+	return ops
+}
+
+// Returns the difference between 'a' and 'b' in the unified diff format,
+// 'aname' and 'bname' are used in the header. Returns nil if there is no
+// difference.
+func unified_diff(aname, bname string, a, b []byte) []byte {
+	ops := diff_lines(split_lines_keep_eol(a), split_lines_keep_eol(b))
+
+	// line numbers in 'a' and 'b' for each op
+	apos := make([]int, len(ops)+1)
+	bpos := make([]int, len(ops)+1)
+	for i, op := range ops {
+		apos[i+1], bpos[i+1] = apos[i], bpos[i]
+		if op.kind != '+' {
+			apos[i+1]++
+		}
+		if op.kind != '-' {
+			bpos[i+1]++
+		}
+	}
+
+	var out bytes.Buffer
+	i := 0
+	for {
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", aname, bname)
+		}
+
+		// extend the hunk while the changes are close enough to each
+		// other to share the context
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				end = j
+			} else if j-end > 2*diff_context_lines {
+				break
+			}
+		}
+		beg := i - diff_context_lines
+		if beg < 0 {
+			beg = 0
+		}
+		stop := end + diff_context_lines + 1
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+
+		alen, blen := apos[stop]-apos[beg], bpos[stop]-bpos[beg]
+		astart, bstart := apos[beg], bpos[beg]
+		if alen > 0 {
+			astart++
+		}
+		if blen > 0 {
+			bstart++
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", astart, alen, bstart, blen)
+		for _, op := range ops[beg:stop] {
+			out.WriteByte(op.kind)
+			out.Write(op.line)
+			if !bytes.HasSuffix(op.line, []byte{'\n'}) {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = stop
+	}
+	if out.Len() == 0 {
+		return nil
+	}
+	return out.Bytes()
+}
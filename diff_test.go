@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+	b := "1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13"
+	expected := `--- a
++++ b
+@@ -1,6 +1,6 @@
+ 1
+ 2
+-3
++three
+ 4
+ 5
+ 6
+@@ -10,3 +10,4 @@
+ 10
+ 11
+ 12
++13
+\ No newline at end of file
+`
+	diff := string(unified_diff("a", "b", []byte(a), []byte(b)))
+	if diff != expected {
+		t.Errorf("unexpected diff:\n%s", diff)
+	}
+
+	if diff := unified_diff("a", "b", []byte(a), []byte(a)); diff != nil {
+		t.Errorf("expected no diff for equal inputs, got:\n%s", diff)
+	}
+
+	// make sure the edit script reproduces both sides
+	a = "x\ny\nz\nx\ny\nz\n"
+	b = "y\nx\nz\nz\nx\n"
+	var ra, rb string
+	for _, op := range diff_lines(split_lines_keep_eol([]byte(a)), split_lines_keep_eol([]byte(b))) {
+		if op.kind != '+' {
+			ra += string(op.line)
+		}
+		if op.kind != '-' {
+			rb += string(op.line)
+		}
+	}
+	if ra != a || rb != b {
+		t.Errorf("edit script is broken: %q, %q", ra, rb)
+	}
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	termbox "github.com/nsf/termbox-go"
+)
+
+//----------------------------------------------------------------------------
+// dired
+//
+// Opening a directory gives a read-only listing buffer, the keys operate on
+// the entry under the cursor or on the marked entries. 'e' makes the names
+// editable, C-c C-c renames everything that was changed in one go, C-c C-k
+// throws the changes away.
+//----------------------------------------------------------------------------
+
+// lines before the first entry (the ".." one)
+const dired_header = 1
+
+type dired struct {
+	godit   *godit
+	buf     *buffer
+	dir     string
+	entries []os.FileInfo
+	marks   map[string]bool
+
+	// names can be edited in place, the name of each entry starts at its
+	// 'prefix_lens' offset (the mode column is not of a fixed width),
+	// 'original' are the lines before editing
+	editing     bool
+	prefix_lens []int
+	original    [][]byte
+	ctrl_c      bool
+}
+
+func (g *godit) new_dired_buffer(dir string) (*buffer, error) {
+	d := &dired{
+		godit: g,
+		dir:   dir,
+		marks: make(map[string]bool),
+	}
+	text, err := d.listing()
+	if err != nil {
+		return nil, err
+	}
+	buf, err := new_buffer(bytes.NewReader(text))
+	if err != nil {
+		return nil, err
+	}
+	buf.path = dir
+	buf.readonly = true
+	buf.keymap = d.on_key
+	d.buf = buf
+
+	// start at the first entry after ".."
+	if buf.lines_n > dired_header+1 {
+		buf.loc.cursor = cursor_location{buf.first_line.next.next, dired_header + 2, 0}
+	}
+	g.set_status("(Dired: <enter> open, m/u mark, D delete, R rename, C copy, + mkdir, g refresh, e edit names)")
+	return buf, nil
+}
+
+func (d *dired) listing() ([]byte, error) {
+	fis, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(fis, func(i, j int) bool {
+		return fis[i].IsDir() && !fis[j].IsDir()
+	})
+	parent, err := os.Stat(filepath.Dir(d.dir))
+	if err != nil {
+		parent, err = os.Stat(d.dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	d.entries = append([]os.FileInfo{parent}, fis...)
+
+	sizew := 1
+	for _, fi := range d.entries {
+		if w := len(strconv.FormatInt(fi.Size(), 10)); w > sizew {
+			sizew = w
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Directory %s:\n", d.dir)
+	d.prefix_lens = d.prefix_lens[:0]
+	for i, fi := range d.entries {
+		mark := ' '
+		name := fi.Name()
+		if i == 0 {
+			name = ".."
+		} else if d.marks[name] {
+			mark = '*'
+		}
+		prefix := fmt.Sprintf("%c %s %*d %s ", mark, fi.Mode(), sizew, fi.Size(),
+			fi.ModTime().Format("2006-01-02 15:04"))
+		d.prefix_lens = append(d.prefix_lens, len(prefix))
+		buf.WriteString(prefix)
+		buf.WriteString(name)
+		if fi.IsDir() {
+			buf.WriteByte('/')
+		}
+		buf.WriteByte('\n')
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte{'\n'}), nil
+}
+
+func (d *dired) refresh(v *view) {
+	line_num := v.cursor.line_num
+	text, err := d.listing()
+	if err != nil {
+		d.godit.set_status("%s", err)
+		return
+	}
+	v.replace_contents(text)
+	d.buf.on_disk = d.buf.history
+	v.move_cursor_to_line(line_num)
+}
+
+// Index of the entry under the cursor, -1 if it's not on an entry.
+func (d *dired) entry_index(v *view) int {
+	i := v.cursor.line_num - dired_header - 1
+	if i < 0 || i >= len(d.entries) {
+		return -1
+	}
+	return i
+}
+
+// Marked entries or the one under the cursor, never "..".
+func (d *dired) selected(v *view) []string {
+	var names []string
+	for _, fi := range d.entries[1:] {
+		if d.marks[fi.Name()] {
+			names = append(names, fi.Name())
+		}
+	}
+	if len(names) == 0 {
+		if i := d.entry_index(v); i > 0 {
+			names = append(names, d.entries[i].Name())
+		}
+	}
+	return names
+}
+
+func (d *dired) open(v *view) {
+	i := d.entry_index(v)
+	if i < 0 {
+		return
+	}
+	path := filepath.Join(d.dir, d.entries[i].Name())
+	if i == 0 {
+		path = filepath.Dir(d.dir)
+	}
+	buf, err := d.godit.new_buffer_from_file(path)
+	if err != nil {
+		return
+	}
+	v.attach(buf)
+}
+
+func (d *dired) mark(v *view, mark bool) {
+	if i := d.entry_index(v); i > 0 {
+		d.marks[d.entries[i].Name()] = mark
+		d.refresh(v)
+	}
+	v.move_cursor_next_line()
+}
+
+func (d *dired) delete(v *view) {
+	g := d.godit
+	names := d.selected(v)
+	if len(names) == 0 {
+		return
+	}
+	what := names[0]
+	if len(names) > 1 {
+		what = fmt.Sprintf("%d entries", len(names))
+	}
+	g.set_overlay_mode(init_key_press_mode(
+		g,
+		map[rune]func(){
+			'y': func() {
+				for _, name := range names {
+					err := os.RemoveAll(filepath.Join(d.dir, name))
+					if err != nil {
+						g.set_status("%s", err)
+						break
+					}
+					delete(d.marks, name)
+				}
+				d.refresh(v)
+			},
+			'n': func() {},
+		},
+		0,
+		"Delete "+what+" (directories recursively)? (y or n)",
+	))
+}
+
+// Asks for a destination and applies 'op' to every selected entry. With a
+// single entry the destination is its new path, unless it's an existing
+// directory, multiple entries go into a directory.
+func (d *dired) transfer(v *view, prompt string, op func(src, dst string) error) {
+	g := d.godit
+	names := d.selected(v)
+	if len(names) == 0 {
+		return
+	}
+	initial := d.dir + string(filepath.Separator)
+	if len(names) == 1 {
+		initial += names[0]
+	}
+	g.set_overlay_mode(init_line_edit_mode(g, line_edit_mode_params{
+		ac_decide:       filesystem_line_ac_decide,
+		prompt:          fmt.Sprintf("%s %d entries to:", prompt, len(names)),
+		initial_content: initial,
+		on_apply: func(linebuf *buffer) {
+			dst := abs_path(string(linebuf.contents()))
+			fi, err := os.Stat(dst)
+			into := err == nil && fi.IsDir()
+			if len(names) > 1 && !into {
+				g.set_status("%s is not a directory", dst)
+				return
+			}
+			for _, name := range names {
+				target := dst
+				if into {
+					target = filepath.Join(dst, name)
+				}
+				if err := op(filepath.Join(d.dir, name), target); err != nil {
+					g.set_status("%s", err)
+					break
+				}
+				delete(d.marks, name)
+			}
+			d.refresh(v)
+		},
+	}))
+}
+
+func (d *dired) make_directory(v *view) {
+	g := d.godit
+	g.set_overlay_mode(init_line_edit_mode(g, line_edit_mode_params{
+		prompt:          "Create directory:",
+		initial_content: d.dir + string(filepath.Separator),
+		on_apply: func(linebuf *buffer) {
+			err := os.MkdirAll(abs_path(string(linebuf.contents())), 0777)
+			if err != nil {
+				g.set_status("%s", err)
+			}
+			d.refresh(v)
+		},
+	}))
+}
+
+//----------------------------------------------------------------------------
+// editing names in place
+//----------------------------------------------------------------------------
+
+func (d *dired) start_editing() {
+	d.original = bytes.Split(d.buf.contents(), []byte{'\n'})
+	d.editing = true
+	d.buf.readonly = false
+	d.godit.set_status("(Editing names: C-c C-c to rename, C-c C-k to cancel)")
+}
+
+func (d *dired) stop_editing(v *view) {
+	d.editing = false
+	d.buf.readonly = true
+	d.refresh(v)
+}
+
+type dired_rename struct{ from, tmp, to string }
+
+// Collects the edited names and renames the entries. Renames go through
+// temporary names, so that names can be swapped. Nothing is renamed when a new
+// name is taken by an entry which stays or by another new name.
+func (d *dired) commit(v *view) {
+	g := d.godit
+	lines := bytes.Split(d.buf.contents(), []byte{'\n'})
+	if len(lines) != len(d.original) {
+		g.set_status("Lines were added or removed, can't rename")
+		return
+	}
+
+	var renames []dired_rename
+	for i, fi := range d.entries[1:] {
+		line := lines[dired_header+1+i]
+		original := d.original[dired_header+1+i]
+		prefix_len := d.prefix_lens[1+i]
+		if len(line) < prefix_len || !bytes.Equal(line[:prefix_len], original[:prefix_len]) {
+			g.set_status("Line %d is broken, can't rename", dired_header+2+i)
+			return
+		}
+		name := string(line[prefix_len:])
+		if fi.IsDir() {
+			name = strings.TrimSuffix(name, "/")
+		}
+		if name == fi.Name() {
+			continue
+		}
+		if name == "" {
+			g.set_status("Empty name on line %d, can't rename", dired_header+2+i)
+			return
+		}
+		renames = append(renames, dired_rename{
+			from: filepath.Join(d.dir, fi.Name()),
+			tmp:  filepath.Join(d.dir, fmt.Sprintf(".tam-rename-%d-%d", os.Getpid(), i)),
+			to:   filepath.Join(d.dir, name),
+		})
+	}
+
+	renamed := make(map[string]bool, len(renames))
+	for _, r := range renames {
+		renamed[r.from] = true
+	}
+	targets := make(map[string]bool, len(renames))
+	for _, r := range renames {
+		if targets[r.to] {
+			g.set_status("More than one entry is renamed to %s, can't rename", r.to)
+			return
+		}
+		targets[r.to] = true
+		if _, err := os.Lstat(r.to); err == nil && !renamed[r.to] {
+			g.set_status("%s already exists, can't rename", r.to)
+			return
+		}
+	}
+
+	var err error
+	done := 0
+	for _, r := range renames {
+		if err = os.Rename(r.from, r.tmp); err != nil {
+			break
+		}
+		done++
+	}
+	if err != nil {
+		// put back what was moved already
+		for _, r := range renames[:done] {
+			os.Rename(r.tmp, r.from)
+		}
+		g.set_status("%s", err)
+		return
+	}
+	var stranded []string
+	for i, r := range renames {
+		if err = os.Rename(r.tmp, r.to); err != nil {
+			stranded = roll_back_renames(renames, i)
+			break
+		}
+	}
+	d.marks = make(map[string]bool)
+	d.stop_editing(v)
+	if len(stranded) != 0 {
+		g.set_status("%s, left as %s", err, strings.Join(stranded, ", "))
+		return
+	}
+	if err != nil {
+		g.set_status("%s", err)
+		return
+	}
+	g.set_status("Renamed %d entries", len(renames))
+}
+
+// Puts everything back after renames[failed] couldn't get its new name: the
+// entries renamed before it go back to their temporary names and from there
+// to the original ones. An entry stays where it is when its original name is
+// taken (which shouldn't happen), the paths of such entries are returned.
+func roll_back_renames(renames []dired_rename, failed int) []string {
+	at_tmp := make([]bool, len(renames))
+	for i, r := range renames {
+		at_tmp[i] = i >= failed || os.Rename(r.to, r.tmp) == nil
+	}
+	var stranded []string
+	for i, r := range renames {
+		if !at_tmp[i] {
+			stranded = append(stranded, r.to)
+			continue
+		}
+		if _, err := os.Lstat(r.from); err == nil || os.Rename(r.tmp, r.from) != nil {
+			stranded = append(stranded, r.tmp)
+		}
+	}
+	return stranded
+}
+
+func (d *dired) on_key(v *view, ev *termbox.Event) bool {
+	if d.editing {
+		if d.ctrl_c {
+			d.ctrl_c = false
+			switch ev.Key {
+			case termbox.KeyCtrlC:
+				d.commit(v)
+			case termbox.KeyCtrlK:
+				d.stop_editing(v)
+				d.godit.set_status("Renaming cancelled")
+			}
+			return true
+		}
+		if ev.Key == termbox.KeyCtrlC {
+			d.ctrl_c = true
+			d.godit.set_status("C-c")
+			return true
+		}
+		return false
+	}
+
+	if ev.Key == termbox.KeyEnter || ev.Key == termbox.KeyCtrlJ {
+		d.open(v)
+		return true
+	}
+	if ev.Mod != 0 || ev.Ch == 0 {
+		return false
+	}
+	switch ev.Ch {
+	case 'm':
+		d.mark(v, true)
+	case 'u':
+		d.mark(v, false)
+	case 'D':
+		d.delete(v)
+	case 'R':
+		d.transfer(v, "Rename", os.Rename)
+	case 'C':
+		d.transfer(v, "Copy", copy_path)
+	case '+':
+		d.make_directory(v)
+	case 'g':
+		d.refresh(v)
+	case 'e':
+		d.start_editing()
+	case 'n':
+		v.move_cursor_next_line()
+	case 'p':
+		v.move_cursor_prev_line()
+	default:
+		return false
+	}
+	return true
+}
+
+// Copies a file or a directory tree, symlinks are copied as symlinks.
+func copy_path(src, dst string) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+	case fi.IsDir():
+		if err := os.Mkdir(dst, fi.Mode().Perm()); err != nil {
+			return err
+		}
+		names, err := readdir_names(src)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			err := copy_path(filepath.Join(src, name), filepath.Join(dst, name))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func readdir_names(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
@@ -0,0 +1,139 @@
+package main
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+import termbox "github.com/nsf/termbox-go"
+
+func TestCopyPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "sub", "a.txt"), []byte("a\n"), 0600)
+	os.Symlink("sub/a.txt", filepath.Join(src, "link"))
+
+	dst := filepath.Join(dir, "dst")
+	if err := copy_path(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dst, "sub", "a.txt"))
+	if err != nil || string(data) != "a\n" {
+		t.Fatalf("copied file: %q, %v", data, err)
+	}
+	if fi, err := os.Stat(filepath.Join(dst, "sub", "a.txt")); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("copied file mode: %v", err)
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "link")); err != nil || target != "sub/a.txt" {
+		t.Fatalf("copied link: %q, %v", target, err)
+	}
+	if err := copy_path(filepath.Join(src, "sub", "a.txt"), filepath.Join(dst, "sub", "a.txt")); err == nil {
+		t.Fatal("copy over an existing file succeeded")
+	}
+}
+
+func TestDiredRename(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+	}
+	// the mode column of a sticky directory is wider than the others
+	os.Mkdir(filepath.Join(dir, "s"), 0755)
+	os.Chmod(filepath.Join(dir, "s"), 0755|os.ModeSticky)
+
+	g := new_godit(nil)
+	buf, err := g.new_dired_buffer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := new_view(g.view_context(), buf)
+	key := func(ev termbox.Event) {
+		buf.keymap(v, &ev)
+	}
+	rename := func(edit func(name string) string) {
+		key(termbox.Event{Ch: 'e'})
+		lines := strings.Split(string(buf.contents()), "\n")
+		for i, line := range lines {
+			j := strings.LastIndexByte(line, ' ')
+			lines[i] = line[:j+1] + edit(line[j+1:])
+		}
+		v.replace_contents([]byte(strings.Join(lines, "\n")))
+		key(termbox.Event{Key: termbox.KeyCtrlC})
+		key(termbox.Event{Key: termbox.KeyCtrlC})
+	}
+	cancel := func() {
+		key(termbox.Event{Key: termbox.KeyCtrlC})
+		key(termbox.Event{Key: termbox.KeyCtrlK})
+	}
+	read := func(name string) string {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		return string(data)
+	}
+
+	// "a" would replace "b", which stays
+	rename(func(name string) string {
+		if name == "a" {
+			return "b"
+		}
+		return name
+	})
+	if read("a") != "a" || read("b") != "b" {
+		t.Fatal("renaming over an existing entry went through")
+	}
+	cancel()
+
+	// two entries with the same new name
+	rename(func(name string) string {
+		if name == "a" || name == "b" {
+			return "d"
+		}
+		return name
+	})
+	if read("a") != "a" || read("b") != "b" || read("d") != "" {
+		t.Fatal("renaming two entries to the same name went through")
+	}
+	cancel()
+
+	// swapping names is fine
+	rename(func(name string) string {
+		switch name {
+		case "a":
+			return "b"
+		case "b":
+			return "a"
+		}
+		return name
+	})
+	if read("a") != "b" || read("b") != "a" || read("c") != "c" {
+		t.Fatalf("swap failed: a=%q b=%q c=%q", read("a"), read("b"), read("c"))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "s")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a swap, then a rename which fails, everything goes back
+	rename(func(name string) string {
+		switch name {
+		case "a":
+			return "b"
+		case "b":
+			return "a"
+		case "c":
+			return "missing/c"
+		}
+		return name
+	})
+	if read("a") != "b" || read("b") != "a" || read("c") != "c" {
+		t.Fatalf("failed renames were not undone: a=%q b=%q c=%q", read("a"), read("b"), read("c"))
+	}
+	if names, _ := readdir_names(dir); len(names) != 4 {
+		t.Fatalf("directory has %q", names)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+//----------------------------------------------------------------------------
+// encodings
+//
+// Buffers always hold UTF-8 text. Files in other encodings are decoded when
+// they're loaded and encoded back when they're written. Bytes which are not
+// valid UTF-8 are kept in the buffer as they are, for editing purposes they
+// are decoded as runes past the unicode range (see 'decode_rune').
+//----------------------------------------------------------------------------
+
+const (
+	enc_utf8     = "utf-8"
+	enc_utf8_bom = "utf-8-bom"
+	enc_utf16le  = "utf-16le"
+	enc_utf16be  = "utf-16be"
+	enc_latin1   = "latin-1"
+	enc_cp1252   = "windows-1252"
+	enc_binary   = "binary"
+)
+
+// Invalid bytes are decoded as 'invalid_rune_base + byte'.
+const invalid_rune_base = utf8.MaxRune + 1
+
+const hex_digits = "0123456789ABCDEF"
+
+var (
+	bom_utf8    = []byte{0xEF, 0xBB, 0xBF}
+	bom_utf16le = []byte{0xFF, 0xFE}
+	bom_utf16be = []byte{0xFE, 0xFF}
+)
+
+// windows-1252 characters in the 0x80-0x9F range, zeros are undefined and
+// are treated as latin-1 control characters
+var cp1252_table = [32]rune{
+	0x20AC, 0, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0, 0x017D, 0,
+	0, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0, 0x017E, 0x0178,
+}
+
+// Like utf8.DecodeRune, but an invalid byte is returned as a rune of its own,
+// so that it's distinguishable from a real U+FFFD.
+func decode_rune(data []byte) (rune, int) {
+	r, rlen := utf8.DecodeRune(data)
+	if r == utf8.RuneError && rlen == 1 {
+		return invalid_rune_base + rune(data[0]), 1
+	}
+	return r, rlen
+}
+
+func decode_last_rune(data []byte) (rune, int) {
+	r, rlen := utf8.DecodeLastRune(data)
+	if r == utf8.RuneError && rlen == 1 {
+		return invalid_rune_base + rune(data[len(data)-1]), 1
+	}
+	return r, rlen
+}
+
+func is_invalid_rune(r rune) bool {
+	return r >= invalid_rune_base
+}
+
+// Guesses the encoding of file contents. BOMs are trusted, other data with NUL
+// bytes in it is binary and valid UTF-8 is UTF-8. Data with some valid
+// multibyte sequences is UTF-8 with a few broken bytes, otherwise it's one of
+// the single byte encodings.
+func detect_encoding(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, bom_utf8):
+		return enc_utf8_bom
+	case bytes.HasPrefix(data, bom_utf16le) && len(data)%2 == 0:
+		return enc_utf16le
+	case bytes.HasPrefix(data, bom_utf16be) && len(data)%2 == 0:
+		return enc_utf16be
+	case bytes.IndexByte(data, 0) != -1:
+		return enc_binary
+	case utf8.Valid(data):
+		return enc_utf8
+	}
+
+	cp1252 := false
+	for len(data) > 0 {
+		r, rlen := utf8.DecodeRune(data)
+		if rlen > 1 {
+			return enc_utf8
+		}
+		if r == utf8.RuneError && data[0] >= 0x80 && data[0] <= 0x9F {
+			if cp1252_table[data[0]-0x80] == 0 {
+				return enc_latin1
+			}
+			cp1252 = true
+		}
+		data = data[rlen:]
+	}
+	if cp1252 {
+		return enc_cp1252
+	}
+	return enc_latin1
+}
+
+// Converts file contents to UTF-8.
+func decode_text(data []byte, enc string) []byte {
+	switch enc {
+	case enc_utf8_bom:
+		return data[len(bom_utf8):]
+	case enc_utf16le, enc_utf16be:
+		data = data[2:]
+		u := make([]uint16, len(data)/2)
+		for i := range u {
+			if enc == enc_utf16le {
+				u[i] = uint16(data[2*i]) | uint16(data[2*i+1])<<8
+			} else {
+				u[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+			}
+		}
+		return []byte(string(utf16.Decode(u)))
+	case enc_latin1, enc_cp1252:
+		out := make([]byte, 0, len(data)+len(data)/8)
+		for _, b := range data {
+			r := rune(b)
+			if enc == enc_cp1252 && b >= 0x80 && b <= 0x9F && cp1252_table[b-0x80] != 0 {
+				r = cp1252_table[b-0x80]
+			}
+			var buf [utf8.UTFMax]byte
+			out = append(out, buf[:utf8.EncodeRune(buf[:], r)]...)
+		}
+		return out
+	}
+	return data
+}
+
+// Converts UTF-8 text back to 'enc', fails if some of the characters can't be
+// represented in it.
+func encode_text(data []byte, enc string) ([]byte, error) {
+	switch enc {
+	case enc_utf8_bom:
+		return append(append([]byte{}, bom_utf8...), data...), nil
+	case enc_utf16le, enc_utf16be:
+		var out bytes.Buffer
+		if enc == enc_utf16le {
+			out.Write(bom_utf16le)
+		} else {
+			out.Write(bom_utf16be)
+		}
+		for len(data) > 0 {
+			r, rlen := decode_rune(data)
+			if is_invalid_rune(r) {
+				return nil, fmt.Errorf("invalid byte 0x%02X can't be encoded in %s",
+					r-invalid_rune_base, enc)
+			}
+			for _, u := range utf16.Encode([]rune{r}) {
+				if enc == enc_utf16le {
+					out.WriteByte(byte(u))
+					out.WriteByte(byte(u >> 8))
+				} else {
+					out.WriteByte(byte(u >> 8))
+					out.WriteByte(byte(u))
+				}
+			}
+			data = data[rlen:]
+		}
+		return out.Bytes(), nil
+	case enc_latin1, enc_cp1252:
+		out := make([]byte, 0, len(data))
+	next:
+		for len(data) > 0 {
+			r, rlen := decode_rune(data)
+			data = data[rlen:]
+			switch {
+			case is_invalid_rune(r):
+				out = append(out, byte(r-invalid_rune_base))
+				continue
+			case enc == enc_cp1252 && r >= 0x100:
+				for i, cr := range cp1252_table {
+					if cr == r {
+						out = append(out, byte(0x80+i))
+						continue next
+					}
+				}
+			case enc == enc_cp1252 && r >= 0x80 && r <= 0x9F && cp1252_table[r-0x80] != 0:
+				// this byte means a different character in windows-1252
+			case r < 0x100:
+				out = append(out, byte(r))
+				continue
+			}
+			return nil, fmt.Errorf("character %q can't be encoded in %s", r, enc)
+		}
+		return out, nil
+	}
+	return data, nil
+}
+
+// Decodes file contents for a buffer, returns the text with '\n' line
+// endings along with the detected encoding and line endings. Binary data is
+// left exactly as it is.
+func decode_file_contents(data []byte) (text []byte, enc string, eol []byte) {
+	enc = detect_encoding(data)
+	if enc == enc_binary {
+		return data, enc, eol_lf
+	}
+	text = decode_text(data, enc)
+	eol = detect_eol(text)
+	return decode_eol(text, eol), enc, eol
+}
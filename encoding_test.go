@@ -0,0 +1,62 @@
+package main
+
+import "strings"
+import "testing"
+
+func TestEncodings(t *testing.T) {
+	tests := []struct {
+		data string
+		enc  string
+		text string
+	}{
+		{"caf\xc3\xa9\n", enc_utf8, "café\n"},
+		{"\xef\xbb\xbfbom\n", enc_utf8_bom, "bom\n"},
+		{"caf\xe9\r\n", enc_latin1, "café\n"},
+		{"\x93quoted\x94 \x80\n", enc_cp1252, "“quoted” €\n"},
+		{"\xff\xfeh\x00i\x00\n\x00", enc_utf16le, "hi\n"},
+		{"\xfe\xff\x00h\x00i\x00\n", enc_utf16be, "hi\n"},
+		{"\xd0\x96 broken \xff\xfe\n", enc_utf8, "\xd0\x96 broken \xff\xfe\n"},
+	}
+	for _, test := range tests {
+		buf, err := new_buffer(strings.NewReader(test.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.encoding != test.enc {
+			t.Errorf("%q detected as %s, expected %s", test.data, buf.encoding, test.enc)
+			continue
+		}
+		if text := string(decode_eol(buf.contents(), buf.eol)); text != test.text {
+			t.Errorf("%q decoded as %q, expected %q", test.data, text, test.text)
+		}
+		data, err := buf.file_contents()
+		if err != nil {
+			t.Errorf("%q: %s", test.data, err)
+		} else if string(data) != test.data {
+			t.Errorf("%q was encoded back as %q", test.data, data)
+		}
+	}
+
+	if _, err := encode_text([]byte("Ж"), enc_latin1); err == nil {
+		t.Errorf("unrepresentable character was encoded")
+	}
+}
+
+func TestInvalidBytes(t *testing.T) {
+	v := new_test_view("a\xff\xc3\xa9\xfe\n")
+	c := v.cursor
+	var offsets []int
+	for !c.eol() {
+		c.move_one_rune_forward()
+		offsets = append(offsets, c.boffset)
+	}
+	if len(offsets) != 4 || offsets[1] != 2 || offsets[2] != 4 || offsets[3] != 5 {
+		t.Errorf("unexpected cursor offsets %v", offsets)
+	}
+	if vo := c.voffset(); vo != 10 {
+		t.Errorf("invalid bytes take %d cells, expected 10", vo)
+	}
+	if r, _ := decode_rune([]byte("\xef\xbf\xbd")); is_invalid_rune(r) {
+		t.Errorf("U+FFFD decoded as an invalid byte")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"path/filepath"
 	"strconv"
 
 	termbox "github.com/nsf/termbox-go"
@@ -62,6 +63,49 @@ func (e extended_mode) on_key(ev *termbox.Event) {
 	case termbox.KeyCtrlS:
 		g.save_active_buffer(false)
 		return
+	case termbox.KeyCtrlV:
+		g.revert_active_buffer()
+		return
+	case termbox.KeyCtrlY:
+		g.yank_from_clipboard()
+	case termbox.KeyEnter:
+		set_eol := func(eol []byte) func() {
+			return func() {
+				if b.set_eol(eol) {
+					g.set_status("Line endings of %s set to %s", b.name, eol_name(eol))
+				}
+			}
+		}
+		g.set_overlay_mode(init_key_press_mode(
+			g,
+			map[rune]func(){
+				'u': set_eol(eol_lf),
+				'd': set_eol(eol_crlf),
+				'm': set_eol(eol_cr),
+			},
+			0,
+			"Line endings: u for LF (unix), d for CRLF (dos), m for CR (mac)",
+		))
+		return
+	case termbox.KeyCtrlD:
+		// the prompt for the file name has to wait until this one is gone
+		prompt := func(lemp func() line_edit_mode_params) func() {
+			return func() {
+				g.asyncFns <- func() {
+					g.set_overlay_mode(init_line_edit_mode(g, lemp()))
+				}
+			}
+		}
+		g.set_overlay_mode(init_key_press_mode(
+			g,
+			map[rune]func(){
+				's': prompt(g.save_session_lemp),
+				'r': prompt(g.restore_session_lemp),
+			},
+			0,
+			"Session: s to save, r to restore",
+		))
+		return
 	case termbox.KeyCtrlSlash:
 		g.active.leaf.on_vcommand(vcommand_redo, 0)
 		g.set_overlay_mode(init_redo_mode(g))
@@ -93,6 +137,25 @@ func (e extended_mode) on_key(ev *termbox.Event) {
 		case 'b':
 			g.set_overlay_mode(init_line_edit_mode(g, g.switch_buffer_lemp()))
 			return
+		case 'f':
+			g.set_overlay_mode(init_line_edit_mode(g, g.recent_files_lemp()))
+			return
+		case 'r':
+			g.set_overlay_mode(init_register_mode(g))
+			return
+		case 'u':
+			g.set_overlay_mode(init_undo_tree_mode(g))
+			return
+		case 'd':
+			dir := "."
+			if b.path != "" {
+				dir = filepath.Dir(b.path)
+			}
+			if buf, err := g.new_buffer_from_file(dir); err == nil {
+				v.attach(buf)
+			}
+		case 'c':
+			v.add_cursors_to_region_lines()
 		case '(':
 			g.set_status("Defining keyboard macro...")
 			g.recording = true
@@ -136,6 +199,13 @@ func (e extended_mode) on_key(ev *termbox.Event) {
 			}
 			g.save_active_buffer(true)
 			return
+		case '%':
+			if ev.Mod&termbox.ModAlt != 0 {
+				g.set_overlay_mode(init_line_edit_mode(g,
+					g.query_replace_lemp1(true)))
+				return
+			}
+			goto undefined
 		case 's':
 			if ev.Mod&termbox.ModAlt != 0 {
 				g.set_overlay_mode(init_line_edit_mode(g,
@@ -150,6 +220,11 @@ func (e extended_mode) on_key(ev *termbox.Event) {
 				r, _ = v.cursor.rune_under()
 			}
 			cursor_ex := make_cursor_location_ex(v.cursor)
+			if is_invalid_rune(r) {
+				g.set_status("Byte: 0x%02X (invalid UTF-8), Cursor offset: %d bytes",
+					r-invalid_rune_base, cursor_ex.abs_boffset)
+				break
+			}
 			g.set_status("Char: %s (dec: %d, oct: %s, hex: %s), Cursor offset: %d bytes",
 				strconv.QuoteRune(r), r,
 				strconv.FormatInt(int64(r), 8),
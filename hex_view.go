@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+
+	termbox "github.com/nsf/termbox-go"
+)
+
+//----------------------------------------------------------------------------
+// hex view
+//
+// Binary buffers are shown as rows of 'hex_row_len' bytes: offset, hex and
+// ASCII columns. The buffer itself is stored the usual way, as lines split by
+// '\n', the cursor is mapped to an absolute byte offset and back, so edits go
+// through the regular actions and undo works as usual.
+//----------------------------------------------------------------------------
+
+const (
+	hex_row_len    = 16
+	hex_offset_len = 10                                 // "00000000  "
+	hex_ascii_col  = hex_offset_len + hex_row_len*3 + 2 // hex bytes, group gap, separator
+)
+
+// Returns the cursor location for an absolute byte offset, the offset is
+// clamped to the buffer size.
+func (b *buffer) offset_to_cursor(offset int) cursor_location {
+	c := cursor_location{b.first_line, 1, 0}
+	for offset > len(c.line.data) && c.line.next != nil {
+		offset -= len(c.line.data) + 1
+		c.line = c.line.next
+		c.line_num++
+	}
+	if offset > len(c.line.data) {
+		offset = len(c.line.data)
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	c.boffset = offset
+	return c
+}
+
+func (b *buffer) byte_at(offset int) byte {
+	c := b.offset_to_cursor(offset)
+	if c.eol() {
+		return '\n'
+	}
+	return c.line.data[c.boffset]
+}
+
+func (v *view) hex_offset() int {
+	return make_cursor_location_ex(v.cursor).abs_boffset
+}
+
+// X coordinate of the byte 'i' of a row in the hex column.
+func hex_column_x(i int) int {
+	x := hex_offset_len + i*3
+	if i >= hex_row_len/2 {
+		x++
+	}
+	return x
+}
+
+func (v *view) hex_move_to(offset int) {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > v.buf.bytes_n {
+		offset = v.buf.bytes_n
+	}
+	v.hex_nibble = 0
+	v.finalize_action_group()
+	v.move_cursor_to(v.buf.offset_to_cursor(offset))
+	v.dirty = dirty_everything
+}
+
+func (v *view) hex_adjust_top(offset int) {
+	row := offset / hex_row_len
+	h := v.height()
+	if row < v.hex_top {
+		v.hex_top = row
+	}
+	if h > 0 && row >= v.hex_top+h {
+		v.hex_top = row - h + 1
+	}
+}
+
+func (v *view) hex_cursor_position() (int, int) {
+	offset := v.hex_offset()
+	v.hex_adjust_top(offset)
+	i := offset % hex_row_len
+	y := offset/hex_row_len - v.hex_top
+	if v.hex_ascii {
+		return hex_ascii_col + i, y
+	}
+	return hex_column_x(i) + v.hex_nibble, y
+}
+
+func (v *view) draw_hex_cell(x, y int, ch rune, fg termbox.Attribute) {
+	if x < 0 || x >= v.uibuf.Width || y < 0 || y >= v.height() {
+		return
+	}
+	v.uibuf.Cells[y*v.uibuf.Width+x] = termbox.Cell{
+		Ch: ch,
+		Fg: fg,
+		Bg: termbox.ColorDefault,
+	}
+}
+
+func (v *view) draw_hex() {
+	v.hex_adjust_top(v.hex_offset())
+
+	c := v.buf.offset_to_cursor(v.hex_top * hex_row_len)
+	offset := v.hex_top * hex_row_len
+	for y, h := 0, v.height(); y < h && offset <= v.buf.bytes_n; y++ {
+		row_start := offset
+		label := fmt.Sprintf("%08X", offset)
+		for i, ch := range label {
+			v.draw_hex_cell(i, y, ch, termbox.ColorYellow)
+		}
+		v.draw_hex_cell(hex_ascii_col-1, y, '|', termbox.ColorDefault)
+		for i := 0; i < hex_row_len && offset < v.buf.bytes_n; i++ {
+			var b byte
+			if c.eol() {
+				b = '\n'
+				c.line = c.line.next
+				c.boffset = 0
+			} else {
+				b = c.line.data[c.boffset]
+				c.boffset++
+			}
+
+			fg := termbox.ColorDefault
+			if b == 0 {
+				fg = termbox.ColorBlue
+			}
+			x := hex_column_x(i)
+			v.draw_hex_cell(x, y, rune(hex_digits[b>>4]), fg)
+			v.draw_hex_cell(x+1, y, rune(hex_digits[b&15]), fg)
+			ch := rune(b)
+			if b < 32 || b >= 127 {
+				ch = '.'
+			}
+			v.draw_hex_cell(hex_ascii_col+i, y, ch, fg)
+			offset++
+		}
+		if offset == row_start || offset%hex_row_len != 0 {
+			// the last row
+			break
+		}
+	}
+}
+
+// Replaces the byte at 'offset' with 'b' or appends it if 'offset' is the end
+// of the buffer. The action group is left open, so that both nibbles of a byte
+// typed in the hex column are undone together.
+func (v *view) hex_set_byte(offset int, b byte) {
+	c := v.buf.offset_to_cursor(offset)
+	if offset < v.buf.bytes_n {
+		v.action_delete(c, 1)
+	}
+	v.action_insert(c, []byte{b})
+}
+
+func (v *view) hex_insert_byte(offset int, b byte) {
+	v.action_insert(v.buf.offset_to_cursor(offset), []byte{b})
+}
+
+func (v *view) hex_delete_byte(offset int) {
+	if offset < 0 || offset >= v.buf.bytes_n {
+		return
+	}
+	v.finalize_action_group()
+	v.action_delete(v.buf.offset_to_cursor(offset), 1)
+	v.finalize_action_group()
+	v.hex_move_to(offset)
+}
+
+func hex_digit_value(ch rune) (byte, bool) {
+	switch {
+	case ch >= '0' && ch <= '9':
+		return byte(ch - '0'), true
+	case ch >= 'a' && ch <= 'f':
+		return byte(ch - 'a' + 10), true
+	case ch >= 'A' && ch <= 'F':
+		return byte(ch - 'A' + 10), true
+	}
+	return 0, false
+}
+
+// Types a character into the hex or the ASCII column, overwriting or
+// inserting depending on 'hex_insert'.
+func (v *view) hex_type(ch rune) {
+	offset := v.hex_offset()
+	if v.hex_ascii {
+		if ch < 32 || ch >= 127 {
+			return
+		}
+		v.finalize_action_group()
+		if v.hex_insert {
+			v.hex_insert_byte(offset, byte(ch))
+		} else {
+			v.hex_set_byte(offset, byte(ch))
+		}
+		v.hex_move_to(offset + 1)
+		return
+	}
+
+	d, ok := hex_digit_value(ch)
+	if !ok {
+		v.ctx.set_status("Not a hex digit: %c", ch)
+		return
+	}
+	if v.hex_nibble == 0 {
+		old := byte(0)
+		if offset < v.buf.bytes_n && !v.hex_insert {
+			old = v.buf.byte_at(offset)
+		}
+		v.finalize_action_group()
+		if v.hex_insert {
+			v.hex_insert_byte(offset, d<<4)
+		} else {
+			v.hex_set_byte(offset, old&0x0F|d<<4)
+		}
+		// the group stays open until the low nibble is typed or the
+		// cursor moves
+		v.move_cursor_to(v.buf.offset_to_cursor(offset))
+		v.hex_nibble = 1
+		return
+	}
+	old := v.buf.byte_at(offset)
+	v.hex_set_byte(offset, old&0xF0|d)
+	v.hex_move_to(offset + 1)
+}
+
+func (v *view) hex_on_key(ev *termbox.Event) {
+	offset := v.hex_offset()
+	page := hex_row_len * (v.height() / 2)
+	if ev.Mod&termbox.ModAlt != 0 {
+		switch ev.Ch {
+		case 'v':
+			v.hex_move_to(offset - page)
+		case '<':
+			v.hex_move_to(0)
+		case '>':
+			v.hex_move_to(v.buf.bytes_n)
+		case 'w':
+			v.on_vcommand(vcommand_copy_region, 0)
+		}
+		return
+	}
+	if ev.Ch != 0 {
+		v.hex_type(ev.Ch)
+		v.dirty = dirty_everything
+		return
+	}
+
+	switch ev.Key {
+	case termbox.KeyCtrlF, termbox.KeyArrowRight:
+		v.hex_move_to(offset + 1)
+	case termbox.KeyCtrlB, termbox.KeyArrowLeft:
+		v.hex_move_to(offset - 1)
+	case termbox.KeyCtrlN, termbox.KeyArrowDown:
+		v.hex_move_to(offset + hex_row_len)
+	case termbox.KeyCtrlP, termbox.KeyArrowUp:
+		v.hex_move_to(offset - hex_row_len)
+	case termbox.KeyCtrlA, termbox.KeyHome:
+		v.hex_move_to(offset - offset%hex_row_len)
+	case termbox.KeyCtrlE, termbox.KeyEnd:
+		v.hex_move_to(offset - offset%hex_row_len + hex_row_len - 1)
+	case termbox.KeyCtrlV, termbox.KeyPgdn:
+		v.hex_move_to(offset + page)
+	case termbox.KeyPgup:
+		v.hex_move_to(offset - page)
+	case termbox.KeyTab:
+		v.hex_ascii = !v.hex_ascii
+		v.hex_nibble = 0
+		v.finalize_action_group()
+	case termbox.KeyInsert:
+		v.hex_insert = !v.hex_insert
+		if v.hex_insert {
+			v.ctx.set_status("Hex: insert mode")
+		} else {
+			v.ctx.set_status("Hex: overwrite mode")
+		}
+	case termbox.KeyDelete, termbox.KeyCtrlD:
+		v.hex_delete_byte(offset)
+	case termbox.KeyBackspace, termbox.KeyBackspace2:
+		v.hex_delete_byte(offset - 1)
+	case termbox.KeyCtrlSlash:
+		v.on_vcommand(vcommand_undo, 0)
+		v.hex_nibble = 0
+	case termbox.KeyCtrlSpace:
+		if ev.Ch == 0 {
+			v.set_mark()
+		}
+	case termbox.KeyCtrlW:
+		v.on_vcommand(vcommand_kill_region, 0)
+	case termbox.KeyCtrlY:
+		v.on_vcommand(vcommand_yank, 0)
+	case termbox.KeySpace:
+		v.hex_type(' ')
+	}
+	v.dirty = dirty_everything
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"github.com/nsf/termbox-go"
+	"regexp"
 	"unicode/utf8"
 )
 
@@ -17,20 +18,41 @@ type isearch_mode struct {
 	failing  bool
 	wrapped  bool
 
+	// regexp isearch (C-M-s, C-M-r), 're' is nil while the pattern typed
+	// so far is not a valid regexp; plain searches use 're' as well when
+	// they ignore case or look for whole words
+	regexp    bool
+	re        *regexp.Regexp
+	match_len int // the length of the current match
+
+	options search_options // toggled with M-c and M-w
+
+	// the text of the buffer for regexp searches, it doesn't change while
+	// searching, so it's joined once
+	data []byte
+
 	prompt_isearch []byte
 	prompt_failing []byte
 	prompt_wrapped []byte
+	prompt_invalid []byte
 }
 
-func init_isearch_mode(g *godit, backward bool) *isearch_mode {
+func init_isearch_mode(g *godit, backward, is_regexp bool) *isearch_mode {
 	v := g.active.leaf
 	m := new(isearch_mode)
 	m.last_word = make([]byte, 0, 32)
 	m.last_loc = v.cursor
 	m.backward = backward
+	m.regexp = is_regexp
 	m.prepare_prompts()
+	start := v.cursor
 	cancel := func() {
+		if v.cursor != start && v.ctx.jumps != nil {
+			v.ctx.jumps.push(v.buf, start)
+		}
 		v.highlight_bytes = nil
+		v.highlight_regexp = nil
+		v.highlight_words = false
 		v.set_tags()
 		v.dirty = dirty_everything
 	}
@@ -40,19 +62,34 @@ func init_isearch_mode(g *godit, backward bool) *isearch_mode {
 		ac_decide: default_ac_decide,
 	})
 	m.set_prompt(m.prompt_isearch)
+	m.compile()
 	return m
 }
 
+// Compiles the search string to 'm.re', unless it can be searched for as it
+// is.
+func (m *isearch_mode) compile() {
+	m.re = nil
+	if m.regexp || len(m.last_word) != 0 && !m.options.plain(m.last_word) {
+		m.re, _ = m.options.compile(m.last_word, m.regexp)
+	}
+}
+
 func (m *isearch_mode) prepare_prompts() {
+	what := "I-search"
 	if m.backward {
-		m.prompt_isearch = []byte("I-search backward:")
-		m.prompt_failing = []byte("Failing I-search backward:")
-		m.prompt_wrapped = []byte("Wrapped I-search backward:")
-	} else {
-		m.prompt_isearch = []byte("I-search:")
-		m.prompt_failing = []byte("Failing I-search:")
-		m.prompt_wrapped = []byte("Wrapped I-search:")
+		what += " backward"
 	}
+	if m.regexp {
+		what = "regexp " + what
+	}
+	// "Case-sensitive regexp I-search:", but "Failing case-sensitive regexp
+	// I-search:"
+	what = m.options.describe(m.last_word, m.regexp) + what
+	m.prompt_isearch = []byte(upper_first(what) + ":")
+	m.prompt_failing = []byte("Failing " + what + ":")
+	m.prompt_wrapped = []byte("Wrapped " + what + ":")
+	m.prompt_invalid = []byte("Invalid " + what + ":")
 }
 
 func (m *isearch_mode) set_prompt(prompt []byte) {
@@ -60,10 +97,11 @@ func (m *isearch_mode) set_prompt(prompt []byte) {
 	m.prompt_w = utf8.RuneCount(m.prompt)
 }
 
-func (m *isearch_mode) search(next bool) {
-	v := m.godit.active.leaf
-	v.finalize_action_group()
-	v.last_vcommand = vcommand_move_cursor_forward
+// Returns the beginning and the end of the match.
+func (m *isearch_mode) find(next bool) (cursor_location, cursor_location, bool) {
+	if m.re != nil {
+		return m.find_regexp(next)
+	}
 
 	var (
 		cursor cursor_location
@@ -84,6 +122,68 @@ func (m *isearch_mode) search(next bool) {
 		}
 		cursor, ok = m.last_loc.search_forward(m.last_word)
 	}
+	end := cursor
+	end.boffset += len(m.last_word)
+	return cursor, end, ok
+}
+
+func (m *isearch_mode) find_regexp(next bool) (cursor_location, cursor_location, bool) {
+	b := m.godit.active.leaf.buf
+	if m.data == nil {
+		m.data = b.joined_lines()
+	}
+	data := m.data
+	from := make_cursor_location_ex(m.last_loc).abs_boffset
+	accept := m.options.accept(data)
+
+	var (
+		match []int
+		ok    bool
+	)
+	if m.backward {
+		if !next {
+			match, ok = regexp_search_forward(data, m.re, from, accept)
+			if !ok || match[0] != from {
+				match, ok = regexp_search_backward(data, m.re, from, accept)
+			}
+		} else {
+			match, ok = regexp_search_backward(data, m.re, from, accept)
+		}
+	} else {
+		if next && !m.wrapped {
+			// step over the current match, even if it's empty
+			if m.match_len > 0 {
+				from += m.match_len
+			} else {
+				from++
+			}
+		}
+		match, ok = regexp_search_forward(data, m.re, from, accept)
+	}
+	if !ok {
+		return cursor_location{}, cursor_location{}, false
+	}
+	return b.offset_to_cursor(match[0]), b.offset_to_cursor(match[1]), true
+}
+
+func (m *isearch_mode) search(next bool) {
+	v := m.godit.active.leaf
+	v.finalize_action_group()
+	v.last_vcommand = vcommand_move_cursor_forward
+	m.prepare_prompts()
+
+	if m.regexp && m.re == nil {
+		// keep the cursor where it is until the pattern is complete
+		v.set_tags()
+		v.highlight_regexp = nil
+		m.set_prompt(m.prompt_invalid)
+		m.failing = false
+		m.wrapped = false
+		v.dirty = dirty_everything
+		return
+	}
+
+	cursor, end, ok := m.find(next)
 	if !ok {
 		v.set_tags()
 		m.set_prompt(m.prompt_failing)
@@ -91,16 +191,17 @@ func (m *isearch_mode) search(next bool) {
 		m.wrapped = false
 	} else {
 		m.last_loc = cursor
+		m.match_len = cursor.distance(end)
 		v.set_tags(view_tag{
 			beg_line:   cursor.line_num,
 			beg_offset: cursor.boffset,
-			end_line:   cursor.line_num,
-			end_offset: cursor.boffset + len(m.last_word),
+			end_line:   end.line_num,
+			end_offset: end.boffset,
 			fg:         termbox.ColorCyan,
 			bg:         termbox.ColorMagenta,
 		})
 		if !m.backward {
-			cursor.boffset += len(m.last_word)
+			cursor = end
 		}
 		v.move_cursor_to(cursor)
 		if m.wrapped {
@@ -113,11 +214,26 @@ func (m *isearch_mode) search(next bool) {
 	}
 	v.center_view_on_cursor()
 	v.dirty = dirty_everything
-	v.highlight_bytes = m.last_word
+	if m.re != nil {
+		v.highlight_bytes = nil
+		v.highlight_regexp = m.re
+		v.highlight_words = m.options.whole_word
+	} else {
+		v.highlight_bytes = m.last_word
+		v.highlight_regexp = nil
+	}
+}
+
+// The last search string of the kind being searched for.
+func (m *isearch_mode) last_search() *[]byte {
+	if m.regexp {
+		return &m.godit.isearch_last_regexp
+	}
+	return &m.godit.isearch_last_word
 }
 
 func (m *isearch_mode) restore_previous_isearch_maybe() {
-	lw := m.godit.isearch_last_word
+	lw := *m.last_search()
 	if len(lw) == 0 {
 		return
 	}
@@ -156,12 +272,20 @@ func (m *isearch_mode) advance_search() {
 	}
 
 	if len(m.last_word) == 0 {
+		// the search starts when the restored word is noticed
 		m.restore_previous_isearch_maybe()
+		return
 	}
 	m.search(true)
 }
 
 func (m *isearch_mode) on_key(ev *termbox.Event) {
+	if m.options.on_key(ev, m.last_word, m.regexp) {
+		m.compile()
+		m.search(false)
+		return
+	}
+
 	switch ev.Key {
 	case termbox.KeyCtrlR:
 		if !m.backward {
@@ -184,6 +308,8 @@ func (m *isearch_mode) on_key(ev *termbox.Event) {
 		return
 	}
 	m.last_word = copy_byte_slice(m.last_word, new_word)
-	m.godit.isearch_last_word = copy_byte_slice(m.godit.isearch_last_word, new_word)
+	last := m.last_search()
+	*last = copy_byte_slice(*last, new_word)
+	m.compile()
 	m.search(false)
 }
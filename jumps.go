@@ -0,0 +1,180 @@
+package main
+
+//----------------------------------------------------------------------------
+// mark ring and jump list
+//
+// Setting the mark pushes the previous one to the buffer's mark ring, C-u
+// C-space jumps to the mark and rotates the ring. Large cursor moves (going
+// to the beginning or the end of the buffer or to a line, isearch, opening
+// and switching buffers) are recorded in the global jump list, which is
+// walked back and forth like a browser history. Both are adjusted on edits
+// the same way the mark is.
+//----------------------------------------------------------------------------
+
+const (
+	mark_ring_max = 16
+	jump_list_max = 100
+)
+
+func adjust_location(c *cursor_location, a *action, what action_type) {
+	switch what {
+	case action_insert:
+		c.on_insert_adjust(a)
+	case action_delete:
+		c.on_delete_adjust(a)
+	}
+}
+
+func (b *buffer) adjust_marks(a *action, what action_type) {
+	if b.is_mark_set() {
+		adjust_location(&b.mark, a, what)
+	}
+	for i := range b.mark_ring {
+		adjust_location(&b.mark_ring[i], a, what)
+	}
+}
+
+// Sets the mark to 'c', the previous mark goes to the mark ring.
+func (b *buffer) push_mark(c cursor_location) {
+	if b.is_mark_set() && b.mark != c {
+		b.mark_ring = append(b.mark_ring, cursor_location{})
+		copy(b.mark_ring[1:], b.mark_ring)
+		b.mark_ring[0] = b.mark
+		if len(b.mark_ring) > mark_ring_max {
+			b.mark_ring = b.mark_ring[:mark_ring_max]
+		}
+	}
+	b.mark = c
+}
+
+// Moves the cursor to the mark, the mark becomes the most recent one from the
+// mark ring and the one jumped to goes to the end of the ring.
+func (v *view) pop_mark() {
+	b := v.buf
+	if !b.is_mark_set() {
+		v.ctx.set_status("No mark set in this buffer")
+		return
+	}
+	m := b.location_at(b.mark.line_num, b.mark.boffset)
+	if len(b.mark_ring) > 0 {
+		b.mark = b.mark_ring[0]
+		b.mark_ring = append(b.mark_ring[1:], m)
+	}
+	v.move_cursor_to(m)
+}
+
+//----------------------------------------------------------------------------
+// jump list
+//----------------------------------------------------------------------------
+
+type jump struct {
+	buf *buffer
+	loc cursor_location
+}
+
+type jump_list struct {
+	jumps []jump
+
+	// the entry last jumped to, len(jumps) when not walking the list
+	pos int
+}
+
+// Records 'loc' as a location jumped from. Entries after the one last jumped
+// to are dropped, like in a browser history.
+func (j *jump_list) push(buf *buffer, loc cursor_location) {
+	if j.pos < len(j.jumps) {
+		j.jumps = j.jumps[:j.pos+1]
+	}
+	n := len(j.jumps)
+	if n > 0 && j.jumps[n-1].buf == buf && j.jumps[n-1].loc.line_num == loc.line_num {
+		j.jumps[n-1].loc = loc
+	} else {
+		j.jumps = append(j.jumps, jump{buf, loc})
+	}
+	if len(j.jumps) > jump_list_max {
+		j.jumps = j.jumps[len(j.jumps)-jump_list_max:]
+	}
+	j.pos = len(j.jumps)
+}
+
+// Returns the previous entry, 'buf' and 'loc' is where the cursor is now, it's
+// recorded when going back from the end of the list, so that it's possible to
+// come back.
+func (j *jump_list) back(buf *buffer, loc cursor_location) (jump, bool) {
+	if j.pos == len(j.jumps) {
+		j.push(buf, loc)
+		j.pos = len(j.jumps) - 1
+	}
+	if j.pos <= 0 {
+		return jump{}, false
+	}
+	j.pos--
+	return j.jumps[j.pos], true
+}
+
+func (j *jump_list) forward() (jump, bool) {
+	if j.pos >= len(j.jumps)-1 {
+		return jump{}, false
+	}
+	j.pos++
+	return j.jumps[j.pos], true
+}
+
+func (j *jump_list) adjust(buf *buffer, a *action, what action_type) {
+	for i := range j.jumps {
+		if j.jumps[i].buf == buf {
+			adjust_location(&j.jumps[i].loc, a, what)
+		}
+	}
+}
+
+func (j *jump_list) remove_buffer(buf *buffer) {
+	kept := j.jumps[:0]
+	pos := j.pos
+	for i, jmp := range j.jumps {
+		if jmp.buf == buf {
+			if i < j.pos {
+				pos--
+			}
+			continue
+		}
+		kept = append(kept, jmp)
+	}
+	j.jumps = kept
+	j.pos = pos
+	if j.pos > len(j.jumps) {
+		j.pos = len(j.jumps)
+	}
+}
+
+func (v *view) push_jump() {
+	if v.ctx.jumps != nil {
+		v.ctx.jumps.push(v.buf, v.cursor)
+	}
+}
+
+func (g *godit) jump_to(j jump) {
+	v := g.active.leaf
+	v.attach(j.buf)
+	v.move_cursor_to(j.buf.location_at(j.loc.line_num, j.loc.boffset))
+	v.center_view_on_cursor()
+}
+
+func (g *godit) jump_back() {
+	v := g.active.leaf
+	j, ok := g.jumps.back(v.buf, v.cursor)
+	if !ok {
+		g.set_status("No earlier location in the jump list")
+		return
+	}
+	g.jump_to(j)
+}
+
+func (g *godit) jump_forward() {
+	j, ok := g.jumps.forward()
+	if !ok {
+		g.set_status("No later location in the jump list")
+		return
+	}
+	g.jump_to(j)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+//----------------------------------------------------------------------------
+// kill ring
+//
+// Every kill which doesn't continue the previous one starts a new entry, at
+// most '-kill-ring' entries are kept. C-y yanks the most recent entry, M-y
+// right after it replaces the yanked text with the previous entry, M-y
+// anywhere else asks which entry to yank. Kills are copied to the system
+// clipboard as well (see clipboard.go).
+//----------------------------------------------------------------------------
+
+type kill_ring struct {
+	entries [][]byte // the most recent first
+
+	// the entry inserted by the last yank, M-y continues from it
+	yank int
+
+	// called with the most recent entry when it changes
+	clipboard func(data []byte)
+}
+
+func (k *kill_ring) head() []byte {
+	if len(k.entries) == 0 {
+		return nil
+	}
+	return k.entries[0]
+}
+
+func (k *kill_ring) push(data []byte) {
+	depth := *kill_ring_depth
+	if depth < 1 {
+		depth = 1
+	}
+	k.entries = append(k.entries, nil)
+	copy(k.entries[1:], k.entries)
+	k.entries[0] = clone_byte_slice(data)
+	if len(k.entries) > depth {
+		k.entries = k.entries[:depth]
+	}
+	k.yank = 0
+}
+
+// Adds 'data' to the most recent entry, at its end or at its beginning.
+func (k *kill_ring) extend(data []byte, prepend bool) {
+	if len(k.entries) == 0 {
+		k.push(data)
+		return
+	}
+	if prepend {
+		k.entries[0] = append(clone_byte_slice(data), k.entries[0]...)
+	} else {
+		k.entries[0] = append(k.entries[0], data...)
+	}
+}
+
+func (k *kill_ring) changed() {
+	if k.clipboard != nil {
+		k.clipboard(k.head())
+	}
+}
+
+func (k *kill_ring) move_to_front(i int) {
+	e := k.entries[i]
+	copy(k.entries[1:i+1], k.entries[:i])
+	k.entries[0] = e
+	k.yank = 0
+}
+
+// Whether the next kill adds to the last one instead of starting a new entry.
+func (v *view) continues_kill() bool {
+	switch v.last_vcommand {
+	case vcommand_kill_word, vcommand_kill_word_backward, vcommand_kill_region, vcommand_kill_line:
+		return true
+	}
+	return false
+}
+
+func (v *view) append_to_kill_buffer(cursor cursor_location, nbytes int) {
+	data := cursor.extract_bytes(nbytes)
+	if v.continues_kill() {
+		v.ctx.kill_ring.extend(data, false)
+	} else {
+		v.ctx.kill_ring.push(data)
+	}
+	v.ctx.kill_ring.changed()
+}
+
+func (v *view) prepend_to_kill_buffer(cursor cursor_location, nbytes int) {
+	data := cursor.extract_bytes(nbytes)
+	if v.continues_kill() {
+		v.ctx.kill_ring.extend(data, true)
+	} else {
+		v.ctx.kill_ring.push(data)
+	}
+	v.ctx.kill_ring.changed()
+}
+
+func (v *view) insert_yanked(data []byte) {
+	cursor := v.cursor
+	v.yank_start = cursor
+	v.action_insert(cursor, clone_byte_slice(data))
+	cursor.move_n_bytes_forward(data)
+	v.move_cursor_to(cursor)
+}
+
+func (v *view) yank() {
+	k := v.ctx.kill_ring
+	if len(k.head()) == 0 {
+		return
+	}
+	k.yank = 0
+	v.insert_yanked(k.head())
+}
+
+func (v *view) can_yank_pop() bool {
+	switch v.last_vcommand {
+	case vcommand_yank, vcommand_yank_pop:
+		return len(v.ctx.kill_ring.entries) > 0
+	}
+	return false
+}
+
+// Replaces the text inserted by the last yank with the next older entry of the
+// kill ring.
+func (v *view) yank_pop() {
+	if !v.can_yank_pop() || v.yank_start.line == nil {
+		return
+	}
+	k := v.ctx.kill_ring
+	k.yank = (k.yank + 1) % len(k.entries)
+	if d := v.yank_start.distance(v.cursor); d > 0 {
+		v.action_delete(v.yank_start, d)
+	}
+	v.move_cursor_to(v.yank_start)
+	v.insert_yanked(k.entries[k.yank])
+	v.ctx.set_status("Yanked kill ring entry %d of %d", k.yank+1, len(k.entries))
+}
+
+// One line description of a kill ring entry for the browser.
+func kill_ring_summary(i int, data []byte) string {
+	first := data
+	more := bytes.Count(data, []byte{'\n'})
+	if n := bytes.IndexByte(data, '\n'); n != -1 {
+		first = data[:n]
+	}
+	const max_len = 60
+	if utf8.RuneCount(first) > max_len {
+		runes := []rune(string(first))
+		first = []byte(string(runes[:max_len]) + "...")
+	}
+	s := fmt.Sprintf("%d: %s", i+1, strings.Replace(string(first), "\t", " ", -1))
+	if more > 0 {
+		s += fmt.Sprintf(" [+%d lines]", more)
+	}
+	return s
+}
+
+// "lemp" stands for "line edit mode params"
+func (g *godit) kill_ring_lemp() line_edit_mode_params {
+	v := g.active.leaf
+	k := &g.kill_ring
+	ac := func(view *view) ([]ac_proposal, int) {
+		pattern := string(view.buf.contents()[:view.cursor.boffset])
+		proposals := make([]ac_proposal, 0, len(k.entries))
+		for i, data := range k.entries {
+			s := kill_ring_summary(i, data)
+			if !strings.HasPrefix(s, pattern) && !bytes.Contains(data, []byte(pattern)) {
+				continue
+			}
+			proposals = append(proposals, ac_proposal{
+				display: []byte(s),
+				content: []byte(s),
+			})
+		}
+		return proposals, view.cursor_coffset
+	}
+	return line_edit_mode_params{
+		ac_decide: func(*view) ac_func {
+			return ac
+		},
+		prompt:         "Yank from kill ring:",
+		init_autocompl: true,
+
+		on_apply: func(linebuf *buffer) {
+			s := string(linebuf.contents())
+			if n := strings.IndexByte(s, ':'); n != -1 {
+				s = s[:n]
+			}
+			i, err := strconv.Atoi(s)
+			if err != nil || i < 1 || i > len(k.entries) {
+				g.set_status("(No such kill ring entry)")
+				return
+			}
+			k.move_to_front(i - 1)
+			k.changed()
+			v.on_vcommand(vcommand_yank, 0)
+		},
+	}
+}
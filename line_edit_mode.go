@@ -28,6 +28,9 @@ type line_edit_mode_params struct {
 	prompt          string
 	initial_content string
 	init_autocompl  bool
+
+	// when set, M-c and M-w toggle the options and the prompt shows them
+	search_options *search_options
 }
 
 func (l *line_edit_mode) exit() {
@@ -37,6 +40,13 @@ func (l *line_edit_mode) exit() {
 }
 
 func (l *line_edit_mode) on_key(ev *termbox.Event) {
+	if l.search_options != nil {
+		defer l.update_search_prompt()
+		if l.search_options.on_key(ev, l.linebuf.first_line.data, false) {
+			return
+		}
+	}
+
 	switch ev.Key {
 	case termbox.KeyEnter, termbox.KeyCtrlJ:
 		if l.lineview.ac != nil {
@@ -59,6 +69,14 @@ func (l *line_edit_mode) on_key(ev *termbox.Event) {
 	}
 }
 
+// Shows the search options in effect in front of the prompt, the case
+// sensitivity depends on what is typed so far.
+func (l *line_edit_mode) update_search_prompt() {
+	o := l.search_options
+	l.prompt = []byte(o.prompt(l.line_edit_mode_params.prompt, l.linebuf.first_line.data, false))
+	l.prompt_w = utf8.RuneCount(l.prompt)
+}
+
 func (l *line_edit_mode) resize(ev *termbox.Event) {
 	w, h := ev.Width-l.prompt_w-1, 1
 	if w < 1 || ev.Height < 1 {
@@ -126,6 +144,9 @@ func init_line_edit_mode(godit *godit, p line_edit_mode_params) *line_edit_mode
 	l.lineview.ac_decide = p.ac_decide // override ac_decide function
 	l.prompt = []byte(p.prompt)
 	l.prompt_w = utf8.RuneCount(l.prompt)
+	if p.search_options != nil {
+		l.update_search_prompt()
+	}
 	l.lineview.resize(l.godit.uibuf.Width-l.prompt_w-1, 1)
 	l.lineview.on_vcommand(vcommand_move_cursor_end_of_line, 0)
 	if l.init_autocompl {
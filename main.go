@@ -2,12 +2,16 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	termbox "github.com/nsf/termbox-go"
 	"github.com/nsf/tulib"
@@ -17,8 +21,20 @@ const (
 	tabstop_length            = 8
 	view_vertical_threshold   = 5
 	view_horizontal_threshold = 10
+	disk_check_interval       = 2 * time.Second
 )
 
+var auto_revert = flag.Bool("auto-revert", false,
+	"reload unmodified buffers when their files change on disk")
+var undo_limit = flag.Int("undo-limit", 64,
+	"memory budget for the undo history of each buffer, in megabytes")
+var kill_ring_depth = flag.Int("kill-ring", 60,
+	"number of killed texts to remember")
+var clipboard_backend = flag.String("clipboard", clipboard_osc52,
+	"how kills are copied to the system clipboard: osc52, wl-copy, xclip or none")
+var session_file = flag.String("session", "",
+	"restore the buffers and the views from this file on start, save them to it on exit")
+
 // this is a structure which represents a key press, used for keyboard macros
 type key_event struct {
 	mod termbox.Modifier
@@ -52,29 +68,44 @@ func (k key_event) to_termbox_event() termbox.Event {
 //----------------------------------------------------------------------------
 
 type godit struct {
-	uibuf             tulib.Buffer
-	active            *view_tree // this one is always a leaf node
-	views             *view_tree // a root node
-	buffers           []*buffer
-	lastcmdclass      vcommand_class
-	statusbuf         bytes.Buffer
-	quitflag          bool
-	overlay           overlay_mode
-	termbox_event     chan termbox.Event
-	keymacros         []key_event
-	recording         bool
-	killbuffer        []byte
-	isearch_last_word []byte
-	s_and_r_last_word []byte
-	s_and_r_last_repl []byte
-	httpPort          int
-	asyncFns          chan func()
+	uibuf                    tulib.Buffer
+	active                   *view_tree // this one is always a leaf node
+	views                    *view_tree // a root node
+	buffers                  []*buffer
+	lastcmdclass             vcommand_class
+	statusbuf                bytes.Buffer
+	quitflag                 bool
+	overlay                  overlay_mode
+	termbox_event            chan termbox.Event
+	keymacros                []key_event
+	recording                bool
+	kill_ring                kill_ring
+	registers                registers
+	rectangle                [][]byte
+	rectangle_string         []byte
+	isearch_last_word        []byte
+	isearch_last_regexp      []byte
+	s_and_r_last_word        []byte
+	s_and_r_last_repl        []byte
+	s_and_r_last_regexp      []byte
+	s_and_r_last_regexp_repl []byte
+	httpPort                 int
+	asyncFns                 chan func()
+	recovery_queue           []*buffer
+	places                   []file_place
+	paste                    paste_state
+	mouse                    mouse_state
+	jumps                    jump_list
+	ctrl_u                   bool
 }
 
 func new_godit(filenames []string) *godit {
 	g := new(godit)
 	g.buffers = make([]*buffer, 0, 20)
-	line := 1
+	g.registers = make(registers)
+	g.kill_ring.clipboard = g.copy_to_clipboard
+	g.places = read_places(places_path())
+	line := 0
 	for _, filename := range filenames {
 		if strings.HasPrefix(filename, "+") {
 			line, _ = strconv.Atoi(filename[1:])
@@ -89,14 +120,24 @@ func new_godit(filenames []string) *godit {
 	}
 	g.views = new_view_tree_leaf(nil, new_view(g.view_context(), g.buffers[0]))
 	g.active = g.views
-	g.active.leaf.move_cursor_to_line(line)
+	if line > 0 {
+		g.active.leaf.move_cursor_to_line(line)
+	}
 	g.keymacros = make([]key_event, 0, 50)
 	g.isearch_last_word = make([]byte, 0, 32)
 	g.asyncFns = make(chan func(), 100)
+	if len(filenames) == 0 {
+		g.restore_startup_session()
+	}
+	g.offer_recovery()
 	return g
 }
 
 func (g *godit) kill_buffer(buf *buffer) {
+	g.remember_places(buf)
+	g.jumps.remove_buffer(buf)
+	g.registers.remove_buffer(buf)
+
 	var replacement *buffer
 	views := make([]*view, len(buf.views))
 	copy(views, buf.views)
@@ -166,7 +207,9 @@ func (g *godit) open_buffers_from_pattern(pattern string) {
 		buf = new_empty_buffer()
 		buf.name = g.buffer_name("unnamed")
 	}
+	g.active.leaf.push_jump()
 	g.active.leaf.attach(buf)
+	g.offer_recovery()
 }
 
 func (g *godit) buffer_name_exists(name string) bool {
@@ -199,24 +242,44 @@ func (g *godit) new_buffer_from_file(filename string) (*buffer, error) {
 		return buf, nil
 	}
 
-	_, err := os.Stat(fullpath)
+	fi, err := os.Stat(disk_path(fullpath))
 	if err != nil {
 		// assume the file is just not there
 		g.set_status("(New file)")
 		buf = new_empty_buffer()
+	} else if fi.IsDir() {
+		buf, err = g.new_dired_buffer(fullpath)
+		if err != nil {
+			g.set_status("%s", err)
+			return nil, err
+		}
+	} else if archive_kind(fullpath) != archive_none && fi.Mode().IsRegular() {
+		buf, err = g.new_archive_buffer(fullpath)
+		if err != nil {
+			g.set_status("%s", err)
+			return nil, err
+		}
 	} else {
-		f, err := os.Open(fullpath)
+		data, raw, codec, err := read_file_contents(fullpath)
 		if err != nil {
 			g.set_status(err.Error())
 			return nil, err
 		}
-		defer f.Close()
-		buf, err = new_buffer(f)
+		buf, err = new_buffer(bytes.NewReader(data))
 		if err != nil {
 			g.set_status(err.Error())
 			return nil, err
 		}
 		buf.path = fullpath
+		buf.codec = codec
+		buf.stamp = make_file_stamp(fi)
+		if p, ok := g.visit_place(fullpath); ok {
+			buf.loc = buf.make_view_location(p.Location)
+		}
+		g.load_undo_history(buf, contents_hash(raw))
+		if buf.has_newer_autosave() {
+			g.recovery_queue = append(g.recovery_queue, buf)
+		}
 	}
 
 	buf.name = g.buffer_name(filename)
@@ -224,6 +287,100 @@ func (g *godit) new_buffer_from_file(filename string) (*buffer, error) {
 	return buf, nil
 }
 
+// Call 'cb' with a view attached to the buffer. If the buffer is not displayed
+// anywhere, a temporary view is used for the duration of the call.
+func (g *godit) with_view(buf *buffer, cb func(v *view)) {
+	if g.active != nil && g.active.leaf.buf == buf {
+		cb(g.active.leaf)
+		return
+	}
+	if len(buf.views) > 0 {
+		cb(buf.views[0])
+		return
+	}
+
+	v := new_view(g.view_context(), buf)
+	cb(v)
+	buf.loc = v.view_location
+	v.detach()
+}
+
+// Reload the buffer contents from disk. It's done as a regular action group,
+// so an unwanted revert can be undone.
+func (g *godit) revert_buffer(buf *buffer) error {
+	if buf.readonly {
+		return err_readonly_buffer
+	}
+	fi, err := os.Stat(disk_path(buf.path))
+	if err != nil {
+		return err
+	}
+	data, _, codec, err := read_file_contents(buf.path)
+	if err != nil {
+		return err
+	}
+	buf.codec = codec
+
+	data, buf.encoding, buf.eol = decode_file_contents(data)
+	g.with_view(buf, func(v *view) {
+		v.replace_contents(data)
+	})
+	buf.on_disk = buf.history
+	buf.stamp = make_file_stamp(fi)
+	buf.remove_autosave()
+	for _, v := range buf.views {
+		v.dirty = dirty_everything
+	}
+	return nil
+}
+
+// used by extended mode only
+func (g *godit) revert_active_buffer() {
+	b := g.active.leaf.buf
+	if b.path == "" {
+		g.set_status("(Buffer is not visiting a file)")
+		g.set_overlay_mode(nil)
+		return
+	}
+
+	revert := func() {
+		if err := g.revert_buffer(b); err != nil {
+			g.set_status("%s", err)
+			return
+		}
+		g.set_status("Reverted %s", b.path)
+	}
+	if b.synced_with_disk() {
+		revert()
+		g.set_overlay_mode(nil)
+		return
+	}
+	g.set_overlay_mode(init_key_press_mode(
+		g,
+		map[rune]func(){
+			'y': revert,
+			'n': func() {},
+		},
+		0,
+		"Buffer "+b.name+" modified; revert anyway? (y or n)",
+	))
+}
+
+// Called periodically from the main loop, reloads unmodified buffers whose
+// files were changed by someone else.
+func (g *godit) auto_revert_buffers() {
+	for _, buf := range g.buffers {
+		if !buf.synced_with_disk() || !buf.changed_on_disk() {
+			continue
+		}
+		if err := g.revert_buffer(buf); err != nil {
+			// most likely the file was removed, leave it as is
+			continue
+		}
+		g.set_status("Reverted %s", buf.path)
+	}
+}
+
 func (g *godit) set_status(format string, args ...interface{}) {
 	g.statusbuf.Reset()
 	fmt.Fprintf(&g.statusbuf, format, args...)
@@ -378,6 +535,9 @@ func (g *godit) on_sys_key(ev *termbox.Event) {
 	case termbox.KeyCtrlG:
 		v := g.active.leaf
 		v.ac = nil
+		if g.overlay == nil {
+			v.remove_cursors()
+		}
 		g.set_overlay_mode(nil)
 		g.set_status("Quit")
 	case termbox.KeyCtrlZ:
@@ -399,23 +559,62 @@ func (g *godit) on_alt_key(ev *termbox.Event) bool {
 	case 'x':
 		g.set_overlay_mode(init_line_edit_mode(g, g.run_command_lemp()))
 		return true
+	case 'y':
+		v := g.active.leaf
+		if v.can_yank_pop() {
+			v.on_vcommand(vcommand_yank_pop, 0)
+		} else if len(g.kill_ring.entries) == 0 {
+			g.set_status("Kill ring is empty")
+		} else {
+			g.set_overlay_mode(init_line_edit_mode(g, g.kill_ring_lemp()))
+		}
+		return true
+	case 'n', 'p':
+		v := g.active.leaf
+		if v.buf.is_binary() {
+			return false
+		}
+		v.add_cursor_at_word(ev.Ch == 'n')
+		return true
+	case ',':
+		g.jump_back()
+		return true
+	case '.':
+		g.jump_forward()
+		return true
 	case '|':
 		g.set_overlay_mode(init_line_edit_mode(g, g.filter_region_lemp()))
 		return true
+	case '%':
+		g.set_overlay_mode(init_line_edit_mode(g, g.query_replace_lemp1(false)))
+		return true
 	}
 	return false
 }
 
 func (g *godit) on_key(ev *termbox.Event) {
 	v := g.active.leaf
+	ctrl_u := g.ctrl_u
+	g.ctrl_u = false
+	if ctrl_u && ev.Key == termbox.KeyCtrlSpace && ev.Ch == 0 {
+		v.pop_mark()
+		return
+	}
+
 	switch ev.Key {
+	case termbox.KeyCtrlU:
+		g.ctrl_u = true
+		g.set_status("C-u")
 	case termbox.KeyCtrlX:
 		g.set_overlay_mode(init_extended_mode(g))
 	case termbox.KeyCtrlS:
-		g.set_overlay_mode(init_isearch_mode(g, false))
+		g.set_overlay_mode(init_isearch_mode(g, false, ev.Mod&termbox.ModAlt != 0))
 	case termbox.KeyCtrlR:
-		g.set_overlay_mode(init_isearch_mode(g, true))
+		g.set_overlay_mode(init_isearch_mode(g, true, ev.Mod&termbox.ModAlt != 0))
 	default:
+		if v.buf.keymap != nil && v.buf.keymap(v, ev) {
+			break
+		}
 		if ev.Mod&termbox.ModAlt != 0 && g.on_alt_key(ev) {
 			break
 		}
@@ -424,6 +623,11 @@ func (g *godit) on_key(ev *termbox.Event) {
 }
 
 func (g *godit) main_loop() {
+	defer g.recover_panic()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM)
+
 	g.termbox_event = make(chan termbox.Event, 20)
 	go func() {
 		for {
@@ -433,6 +637,16 @@ func (g *godit) main_loop() {
 
 	go g.startHTTPServer()
 
+	var disk_check <-chan time.Time
+	if *auto_revert {
+		t := time.NewTicker(disk_check_interval)
+		defer t.Stop()
+		disk_check = t.C
+	}
+
+	idle := time.NewTimer(autosave_idle_time)
+	defer idle.Stop()
+
 	for {
 		select {
 		case ev := <-g.termbox_event:
@@ -441,8 +655,15 @@ func (g *godit) main_loop() {
 				return
 			}
 			g.consume_more_events()
+			idle.Reset(autosave_idle_time)
 		case fn := <-g.asyncFns:
 			fn()
+		case <-disk_check:
+			g.auto_revert_buffers()
+		case <-idle.C:
+			g.autosave_buffers()
+		case sig := <-signals:
+			g.emergency_exit("Terminated by " + sig.String())
 		}
 		g.draw()
 		termbox.Flush()
@@ -464,23 +685,30 @@ func (g *godit) consume_more_events() bool {
 	panic("unreachable")
 }
 
+func (g *godit) handle_key_event(ev *termbox.Event) bool {
+	if g.recording {
+		g.keymacros = append(g.keymacros, create_key_event(ev))
+	}
+	g.set_status("") // reset status on every key event
+	g.on_sys_key(ev)
+	if g.overlay != nil {
+		g.overlay.on_key(ev)
+	} else {
+		g.on_key(ev)
+	}
+	return !g.quitflag
+}
+
 func (g *godit) handle_event(ev *termbox.Event) bool {
 	switch ev.Type {
 	case termbox.EventKey:
-		if g.recording {
-			g.keymacros = append(g.keymacros, create_key_event(ev))
-		}
-		g.set_status("") // reset status on every key event
-		g.on_sys_key(ev)
-		if g.overlay != nil {
-			g.overlay.on_key(ev)
-		} else {
-			g.on_key(ev)
-		}
-
-		if g.quitflag {
-			return false
+		for _, ev := range g.filter_paste(*ev) {
+			if !g.handle_key_event(&ev) {
+				return false
+			}
 		}
+	case termbox.EventMouse:
+		g.on_mouse(ev)
 	case termbox.EventResize:
 		termbox.Clear(termbox.ColorDefault, termbox.ColorDefault)
 		g.resize()
@@ -517,13 +745,23 @@ func (g *godit) save_active_buffer(raw bool) {
 			return
 		}
 
-		v.presave_cleanup(raw)
-		err := b.save()
-		if err != nil {
-			g.set_status(err.Error())
-		} else {
-			g.set_status("Wrote %s", b.path)
+		save := func() {
+			v.presave_cleanup(raw)
+			g.report_save(b.path, b.save())
+		}
+		if b.changed_on_disk() {
+			g.set_overlay_mode(init_key_press_mode(
+				g,
+				map[rune]func(){
+					'y': save,
+					'n': func() {},
+				},
+				0,
+				b.path+" changed on disk; save anyway? (y or n)",
+			))
+			return
 		}
+		save()
 		g.set_overlay_mode(nil)
 		return
 	}
@@ -542,6 +780,7 @@ func (g *godit) switch_buffer_lemp() line_edit_mode_params {
 			bufname := string(buf.contents())
 			for _, buf := range g.buffers {
 				if buf.name == bufname {
+					g.active.leaf.push_jump()
 					g.active.leaf.attach(buf)
 					return
 				}
@@ -568,6 +807,21 @@ func (g *godit) open_buffer_lemp() line_edit_mode_params {
 	}
 }
 
+// Tells how saving to 'path' went, returns true if the file was written. A
+// file without its undo history is still saved.
+func (g *godit) report_save(path string, err error) bool {
+	if uerr, ok := err.(*undo_history_error); ok {
+		g.set_status("Wrote %s (%s)", path, uerr)
+		return true
+	}
+	if err != nil {
+		g.set_status("%s", err)
+		return false
+	}
+	g.set_status("Wrote %s", path)
+	return true
+}
+
 // "lemp" stands for "line edit mode params"
 func (g *godit) save_as_buffer_lemp(raw bool) line_edit_mode_params {
 	v := g.active.leaf
@@ -581,15 +835,11 @@ func (g *godit) save_as_buffer_lemp(raw bool) line_edit_mode_params {
 			v.presave_cleanup(raw)
 			name := string(linebuf.contents())
 			fullpath := abs_path(name)
-			err := b.save_as(fullpath)
-			if err != nil {
-				g.set_status(err.Error())
-			} else {
+			if g.report_save(fullpath, b.save_as(fullpath)) {
 				b.name = ""
 				b.name = g.buffer_name(name)
 				b.path = fullpath
 				v.dirty |= dirty_status
-				g.set_status("Wrote %s", b.path)
 			}
 		},
 	}
@@ -675,6 +925,7 @@ func (g *godit) goto_line_lemp() line_edit_mode_params {
 				g.set_status(err.Error())
 				return
 			}
+			v.push_jump()
 			v.on_vcommand(vcommand_move_cursor_to_line, rune(num))
 		},
 	}
@@ -688,8 +939,10 @@ func (g *godit) search_and_replace_lemp1() line_edit_mode_params {
 	} else {
 		prompt = "Replace string:"
 	}
+	var opts search_options
 	return line_edit_mode_params{
-		prompt: prompt,
+		prompt:         prompt,
+		search_options: &opts,
 		on_apply: func(buf *buffer) {
 			var word []byte
 			contents := buf.contents()
@@ -704,13 +957,13 @@ func (g *godit) search_and_replace_lemp1() line_edit_mode_params {
 				g.set_status("Nothing to replace")
 				return
 			}
-			g.set_overlay_mode(init_line_edit_mode(g, g.search_and_replace_lemp2(word)))
+			g.set_overlay_mode(init_line_edit_mode(g, g.search_and_replace_lemp2(word, opts)))
 		},
 	}
 }
 
 // "lemp" stands for "line edit mode params"
-func (g *godit) search_and_replace_lemp2(word []byte) line_edit_mode_params {
+func (g *godit) search_and_replace_lemp2(word []byte, opts search_options) line_edit_mode_params {
 	var prompt string
 	if len(g.s_and_r_last_repl) != 0 {
 		prompt = fmt.Sprintf("Replace string %s with [%s]:", word, g.s_and_r_last_repl)
@@ -732,7 +985,7 @@ func (g *godit) search_and_replace_lemp2(word []byte) line_edit_mode_params {
 			}
 			v.finalize_action_group()
 			v.last_vcommand = vcommand_none
-			g.active.leaf.search_and_replace(word, repl)
+			g.active.leaf.search_and_replace(word, repl, opts)
 			v.finalize_action_group()
 			g.s_and_r_last_word = word
 			g.s_and_r_last_repl = repl
@@ -759,7 +1012,7 @@ func (g *godit) stop_recording() {
 func (g *godit) replay_macro() {
 	for _, keyev := range g.keymacros {
 		ev := keyev.to_termbox_event()
-		g.handle_event(&ev)
+		g.handle_key_event(&ev)
 	}
 }
 
@@ -768,8 +1021,10 @@ func (g *godit) view_context() view_context {
 		set_status: func(f string, args ...interface{}) {
 			g.set_status(f, args...)
 		},
-		kill_buffer: &g.killbuffer,
-		buffers:     &g.buffers,
+		kill_ring: &g.kill_ring,
+		buffers:   &g.buffers,
+		jumps:     &g.jumps,
+		registers: g.registers,
 	}
 }
 
@@ -783,17 +1038,37 @@ func (g *godit) has_unsaved_buffers() bool {
 }
 
 func main() {
+	flag.Parse()
+	switch *clipboard_backend {
+	case clipboard_osc52, clipboard_wl, clipboard_xclip, clipboard_none:
+	default:
+		fmt.Fprintf(os.Stderr, "unknown clipboard backend: %s\n", *clipboard_backend)
+		os.Exit(2)
+	}
 	err := termbox.Init()
 	if err != nil {
 		panic(err)
 	}
-	defer termbox.Close()
-	termbox.SetInputMode(termbox.InputAlt)
+	var session_err error
+	defer func() {
+		set_bracketed_paste(false)
+		termbox.Close()
+		if session_err != nil {
+			fmt.Fprintf(os.Stderr, "failed to save the session: %s\n", session_err)
+			os.Exit(1)
+		}
+	}()
+	termbox.SetInputMode(termbox.InputAlt | termbox.InputMouse)
 	termbox.SetOutputMode(termbox.Output256)
-	godit := new_godit(os.Args[1:])
+	set_bracketed_paste(true)
+	godit := start_godit(flag.Args())
 	godit.resize()
 	godit.draw()
 	termbox.SetCursor(godit.cursor_position())
 	termbox.Flush()
 	godit.main_loop()
+	godit.remember_places(godit.buffers...)
+	if *session_file != "" {
+		session_err = godit.save_session(abs_path(*session_file))
+	}
 }
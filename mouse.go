@@ -0,0 +1,278 @@
+package main
+
+import (
+	"github.com/nsf/termbox-go"
+)
+
+//----------------------------------------------------------------------------
+// mouse
+//
+// A click focuses the view under the pointer and moves its cursor there.
+// Dragging sets the mark where the button was pressed and moves the cursor
+// along, so the region is what was dragged over. The wheel scrolls the view
+// under the pointer. Splitters (the column between views split horizontally
+// and the status bar of the upper view) can be dragged to resize the views.
+// A right click adds an extra cursor (see multi_cursor.go) or removes one.
+// Mouse events are ignored while an overlay mode is active.
+//----------------------------------------------------------------------------
+
+const mouse_wheel_lines = 3
+
+type mouse_state struct {
+	// the split which splitter is being dragged
+	splitter *view_tree
+
+	// the view where the button was pressed and the location under it, the
+	// mark is set there on the first move
+	selecting *view_tree
+	press     cursor_location
+	dragged   bool
+}
+
+func (v *view_tree) contains(x, y int) bool {
+	return x >= v.X && x < v.X+v.Width && y >= v.Y && y < v.Y+v.Height
+}
+
+func (v *view_tree) leaf_at(x, y int) *view_tree {
+	var found *view_tree
+	v.traverse(func(leaf *view_tree) {
+		if leaf.contains(x, y) {
+			found = leaf
+		}
+	})
+	return found
+}
+
+// Returns the split which splitter is at 'x', 'y'.
+func (v *view_tree) splitter_at(x, y int) *view_tree {
+	if v.leaf != nil || !v.contains(x, y) {
+		return nil
+	}
+	if v.left != nil {
+		if x == v.left.X+v.left.Width {
+			return v
+		}
+		if s := v.left.splitter_at(x, y); s != nil {
+			return s
+		}
+		return v.right.splitter_at(x, y)
+	}
+	if v.top.Height > 0 && y == v.top.Y+v.top.Height-1 {
+		return v
+	}
+	if s := v.top.splitter_at(x, y); s != nil {
+		return s
+	}
+	return v.bottom.splitter_at(x, y)
+}
+
+// Moves the splitter to 'x' or 'y', whichever applies to the split.
+func (v *view_tree) drag_splitter(x, y int) {
+	if v.Width <= 1 || v.Height <= 0 {
+		return
+	}
+	one := v.one_step()
+	if v.left != nil {
+		v.split = (float32(x-v.X) + 0.5) * one
+	} else {
+		// the splitter is the last line of the top view
+		v.split = (float32(y-v.Y+1) + 0.5) * one
+	}
+	if v.split > 1.0 {
+		v.split = 1.0
+	}
+	if v.split < 0.0 {
+		v.split = 0.0
+	}
+	v.resize(v.Rect)
+}
+
+// Returns the buffer location shown at 'x', 'y' of the view's contents, the
+// cell is mapped back through tab expansion and the horizontal scroll of the
+// cursor line. Cells past the end of a line map to its end, the ones below the
+// last line map to the end of the buffer.
+func (v *view) location_at(x, y int) cursor_location {
+	if x < 0 {
+		x = 0
+	}
+	if y < 0 {
+		y = 0
+	}
+	if v.buf.is_binary() {
+		return v.buf.offset_to_cursor(v.hex_offset_at(x, y))
+	}
+
+	c := cursor_location{v.top_line, v.top_line_num, 0}
+	for i := 0; i < y; i++ {
+		if c.line.next == nil {
+			c.boffset = len(c.line.data)
+			return c
+		}
+		c.line = c.line.next
+		c.line_num++
+	}
+	if c.line == v.cursor.line {
+		x += v.line_voffset
+	}
+	c.boffset, _, _ = c.line.find_closest_offsets(x)
+	return c
+}
+
+// Returns the byte offset shown at 'x', 'y' of the hex view.
+func (v *view) hex_offset_at(x, y int) int {
+	i := 0
+	switch {
+	case x >= hex_ascii_col:
+		i = x - hex_ascii_col
+	case x >= hex_offset_len:
+		for i+1 < hex_row_len && hex_column_x(i+1) <= x {
+			i++
+		}
+	}
+	if i >= hex_row_len {
+		i = hex_row_len - 1
+	}
+	return (v.hex_top+y)*hex_row_len + i
+}
+
+func (v *view) move_cursor_to_cell(x, y int) {
+	v.last_vcommand = vcommand_none
+	if v.buf.is_binary() {
+		v.hex_ascii = x >= hex_ascii_col
+		v.hex_move_to(v.hex_offset_at(x, y))
+		return
+	}
+	v.move_cursor_to(v.location_at(x, y))
+}
+
+func (v *view) scroll_by_wheel(n int) {
+	if v.buf.is_binary() {
+		v.hex_top += n
+		if last := v.buf.bytes_n/hex_row_len - v.height() + 1; v.hex_top > last {
+			v.hex_top = last
+		}
+		if v.hex_top < 0 {
+			v.hex_top = 0
+		}
+		// keep the cursor visible, it's where the drawing starts from
+		offset := v.hex_offset()
+		row := offset / hex_row_len
+		if h := v.height(); row >= v.hex_top+h {
+			offset -= (row - (v.hex_top + h - 1)) * hex_row_len
+		} else if row < v.hex_top {
+			offset += (v.hex_top - row) * hex_row_len
+		}
+		v.hex_move_to(offset)
+		return
+	}
+	// moves as far as possible at the beginning and the end of the buffer
+	v.move_view_n_lines(n)
+}
+
+func (g *godit) focus(leaf *view_tree) {
+	if leaf == g.active {
+		return
+	}
+	g.active.leaf.deactivate()
+	g.active = leaf
+	g.active.leaf.activate()
+}
+
+func (g *godit) on_mouse(ev *termbox.Event) {
+	m := &g.mouse
+	if g.overlay != nil {
+		m.splitter, m.selecting = nil, nil
+		return
+	}
+
+	switch ev.Key {
+	case termbox.MouseWheelUp, termbox.MouseWheelDown:
+		leaf := g.views.leaf_at(ev.MouseX, ev.MouseY)
+		if leaf == nil {
+			return
+		}
+		n := mouse_wheel_lines
+		if ev.Key == termbox.MouseWheelUp {
+			n = -n
+		}
+		leaf.leaf.scroll_by_wheel(n)
+	case termbox.MouseRight:
+		g.on_mouse_right(ev.MouseX, ev.MouseY)
+	case termbox.MouseRelease:
+		m.splitter, m.selecting = nil, nil
+	case termbox.MouseLeft:
+		if ev.Mod&termbox.ModMotion != 0 {
+			g.on_mouse_drag(ev.MouseX, ev.MouseY)
+			return
+		}
+		g.on_mouse_press(ev.MouseX, ev.MouseY)
+	}
+}
+
+func (g *godit) on_mouse_press(x, y int) {
+	m := &g.mouse
+	m.splitter, m.selecting = nil, nil
+	if s := g.views.splitter_at(x, y); s != nil {
+		m.splitter = s
+		return
+	}
+	leaf := g.views.leaf_at(x, y)
+	if leaf == nil {
+		return
+	}
+	g.focus(leaf)
+	v := leaf.leaf
+	x, y = x-leaf.X, y-leaf.Y
+	if y >= v.height() {
+		// the status bar of the bottom views
+		return
+	}
+	v.move_cursor_to_cell(x, y)
+	m.selecting = leaf
+	m.press = v.cursor
+	m.dragged = false
+}
+
+// Adds an extra cursor at the pointer, or removes the one there.
+func (g *godit) on_mouse_right(x, y int) {
+	leaf := g.views.leaf_at(x, y)
+	if leaf == nil {
+		return
+	}
+	g.focus(leaf)
+	v := leaf.leaf
+	x, y = x-leaf.X, y-leaf.Y
+	if y >= v.height() || v.buf.is_binary() {
+		return
+	}
+	v.toggle_cursor(v.location_at(x, y))
+}
+
+func (g *godit) on_mouse_drag(x, y int) {
+	m := &g.mouse
+	if m.splitter != nil {
+		m.splitter.drag_splitter(x, y)
+		return
+	}
+	if m.selecting == nil || m.selecting != g.active {
+		return
+	}
+	leaf := m.selecting
+	v := leaf.leaf
+	x, y = x-leaf.X, y-leaf.Y
+	if !m.dragged {
+		m.dragged = true
+		v.buf.push_mark(m.press)
+	}
+
+	// dragging past the edges scrolls the view
+	if y < 0 {
+		v.maybe_move_view_n_lines(-1)
+		y = 0
+	}
+	if h := v.height(); y >= h {
+		v.maybe_move_view_n_lines(1)
+		y = h - 1
+	}
+	v.move_cursor_to_cell(x, y)
+}
@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+import "github.com/nsf/tulib"
+
+func TestMouseLocation(t *testing.T) {
+	v := new_test_view("a\tb\nsecond\n")
+	v.resize(20, 5)
+	tests := []struct {
+		x, y     int
+		line_num int
+		boffset  int
+	}{
+		{0, 0, 1, 0},
+		{4, 0, 1, 1}, // inside the tab
+		{8, 0, 1, 2},
+		{15, 0, 1, 3}, // past the end of the line
+		{3, 1, 2, 3},
+		{5, 4, 3, 0}, // below the last line
+	}
+	for _, tt := range tests {
+		c := v.location_at(tt.x, tt.y)
+		if c.line_num != tt.line_num || c.boffset != tt.boffset {
+			t.Errorf("%d,%d: got %d:%d, want %d:%d", tt.x, tt.y,
+				c.line_num, c.boffset, tt.line_num, tt.boffset)
+		}
+	}
+
+	// the horizontal scroll applies to the cursor line only
+	v.move_cursor_to(v.location_at(3, 1))
+	v.line_voffset = 2
+	if c := v.location_at(1, 1); c.boffset != 3 {
+		t.Errorf("scrolled cursor line: got offset %d, want 3", c.boffset)
+	}
+	if c := v.location_at(1, 0); c.boffset != 1 {
+		t.Errorf("other line: got offset %d, want 1", c.boffset)
+	}
+}
+
+func TestMouseSplitters(t *testing.T) {
+	v := new_test_view("")
+	root := new_view_tree_leaf(nil, v)
+	root.split_horizontally()
+	root.right.split_vertically()
+	root.resize(tulib.Rect{0, 0, 21, 10})
+
+	if s := root.splitter_at(10, 3); s != root {
+		t.Errorf("vertical splitter not found")
+	}
+	if s := root.splitter_at(15, 4); s != root.right {
+		t.Errorf("status bar of the upper view is not a splitter")
+	}
+	if s := root.splitter_at(5, 4); s != nil {
+		t.Errorf("unexpected splitter inside the left view")
+	}
+	if leaf := root.leaf_at(15, 7); leaf != root.right.bottom {
+		t.Errorf("wrong leaf at 15,7")
+	}
+
+	root.drag_splitter(5, 0)
+	if root.left.Width != 5 || root.right.X != 6 {
+		t.Errorf("dragged to %d, right view at %d", root.left.Width, root.right.X)
+	}
+	root.right.drag_splitter(0, 2)
+	if root.right.top.Height != 3 {
+		t.Errorf("upper view height %d, want 3", root.right.top.Height)
+	}
+}
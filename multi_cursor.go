@@ -0,0 +1,277 @@
+package main
+
+import (
+	"github.com/nsf/termbox-go"
+)
+
+//----------------------------------------------------------------------------
+// multiple cursors
+//
+// Besides its cursor a view may have extra cursors. Editing and movement
+// commands run at the cursor first and then at each extra cursor, all the
+// changes land in one action group, so a single undo reverts them. Extra
+// cursors follow the edits the same way the mark does. Commands working on the
+// region or on the whole view run at the cursor only. Kills at the extra
+// cursors don't go to the kill ring, each of them sees a copy of it. Every
+// cursor remembers where its last yank started, so M-y works at all of them.
+// C-g removes the extra cursors.
+//----------------------------------------------------------------------------
+
+type extra_cursor struct {
+	cursor_location
+	last_voffset int             // see view.last_cursor_voffset
+	yank_start   cursor_location // see view.yank_start
+}
+
+func (c vcommand) at_every_cursor() bool {
+	switch c {
+	case vcommand_move_cursor_forward,
+		vcommand_move_cursor_backward,
+		vcommand_move_cursor_word_forward,
+		vcommand_move_cursor_word_backward,
+		vcommand_move_cursor_next_line,
+		vcommand_move_cursor_prev_line,
+		vcommand_move_cursor_beginning_of_line,
+		vcommand_move_cursor_end_of_line,
+		vcommand_insert_rune,
+		vcommand_yank,
+		vcommand_yank_pop,
+		vcommand_delete_rune_backward,
+		vcommand_delete_rune,
+		vcommand_kill_line,
+		vcommand_kill_word,
+		vcommand_kill_word_backward,
+		vcommand_word_to_upper,
+		vcommand_word_to_title,
+		vcommand_word_to_lower:
+		return true
+	}
+	return false
+}
+
+func (b *buffer) adjust_cursors(a *action, what action_type) {
+	for _, v := range b.views {
+		for i := range v.cursors {
+			c := &v.cursors[i]
+			adjust_location(&c.cursor_location, a, what)
+			if c.yank_start.line != nil {
+				adjust_location(&c.yank_start, a, what)
+			}
+		}
+	}
+}
+
+func (v *view) set_cursor(c extra_cursor) {
+	v.cursor = c.cursor_location
+	v.cursor_voffset, v.cursor_coffset = v.cursor.voffset_coffset()
+	v.last_cursor_voffset = c.last_voffset
+	v.yank_start = c.yank_start
+}
+
+func (v *view) primary_cursor() extra_cursor {
+	return extra_cursor{v.cursor, v.last_cursor_voffset, v.yank_start}
+}
+
+// Runs 'cmd' at every extra cursor. While it runs at one of them, the view's
+// cursor takes its place in 'cursors', so that it's adjusted by the edits.
+// The view doesn't scroll to follow the extra cursors. 'yank' is the kill
+// ring entry of the last yank before 'cmd' ran at the cursor, M-y at the
+// extra cursors continues from it as well.
+func (v *view) run_at_extra_cursors(cmd vcommand, arg rune, yank int) {
+	v.ac = nil
+	top_line_num, line_voffset := v.top_line_num, v.line_voffset
+	ring := v.ctx.kill_ring
+	for i := range v.cursors {
+		c := &v.cursors[i]
+		primary := v.primary_cursor()
+		v.set_cursor(*c)
+		*c = primary
+		v.ctx.kill_ring = &kill_ring{
+			entries: append([][]byte(nil), ring.entries...),
+			yank:    yank,
+		}
+		v.run_vcommand(cmd, arg)
+		primary = *c
+		*c = v.primary_cursor()
+		v.set_cursor(primary)
+	}
+	v.ctx.kill_ring = ring
+
+	v.move_top_line_n_times(top_line_num - v.top_line_num)
+	v.line_voffset = line_voffset
+	v.adjust_line_voffset()
+	v.adjust_top_line()
+	v.merge_cursors()
+	v.dirty = dirty_everything
+}
+
+func same_location(a, b cursor_location) bool {
+	return a.line == b.line && a.boffset == b.boffset
+}
+
+func (v *view) cursor_index(c cursor_location) int {
+	for i := range v.cursors {
+		if same_location(v.cursors[i].cursor_location, c) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Drops the extra cursors which ended up at the same place as another one.
+func (v *view) merge_cursors() {
+	kept := v.cursors[:0]
+	for _, c := range v.cursors {
+		dup := same_location(c.cursor_location, v.cursor)
+		for _, k := range kept {
+			if same_location(c.cursor_location, k.cursor_location) {
+				dup = true
+			}
+		}
+		if !dup {
+			kept = append(kept, c)
+		}
+	}
+	v.cursors = kept
+}
+
+func (v *view) remove_cursors() {
+	if len(v.cursors) != 0 {
+		v.cursors = nil
+		v.dirty = dirty_everything
+	}
+}
+
+func (v *view) report_cursors() {
+	v.ctx.set_status("%d cursors", len(v.cursors)+1)
+}
+
+// Adds an extra cursor at 'c' or removes the one which is there.
+func (v *view) toggle_cursor(c cursor_location) {
+	v.dirty = dirty_everything
+	if i := v.cursor_index(c); i != -1 {
+		v.cursors = append(v.cursors[:i], v.cursors[i+1:]...)
+		v.report_cursors()
+		return
+	}
+	if same_location(c, v.cursor) {
+		return
+	}
+	v.cursors = append(v.cursors, extra_cursor{c, c.voffset(), cursor_location{}})
+	v.report_cursors()
+}
+
+// Returns the word around 'c'.
+func (c cursor_location) word_bounds() (beg, end cursor_location, ok bool) {
+	beg, end = c, c
+	for {
+		r, rlen := beg.rune_before()
+		if rlen == 0 || !is_word(r) {
+			break
+		}
+		beg.boffset -= rlen
+	}
+	for {
+		r, rlen := end.rune_under()
+		if rlen == 0 || !is_word(r) {
+			break
+		}
+		end.boffset += rlen
+	}
+	return beg, end, beg.boffset != end.boffset
+}
+
+// Whether the 'n' bytes at 'c' are a whole word, not a part of a longer one.
+func (c cursor_location) is_whole_word(n int) bool {
+	if r, rlen := c.rune_before(); rlen != 0 && is_word(r) {
+		return false
+	}
+	c.boffset += n
+	if r, rlen := c.rune_under(); rlen != 0 && is_word(r) {
+		return false
+	}
+	return true
+}
+
+// Finds the next (or the previous) occurrence of the word under the cursor
+// which doesn't have a cursor yet. The cursor moves there, at the same offset
+// within the word, and an extra cursor is left in its place.
+func (v *view) add_cursor_at_word(forward bool) {
+	beg, end, ok := v.cursor.word_bounds()
+	if !ok {
+		v.ctx.set_status("No word under the cursor")
+		return
+	}
+	word := clone_byte_slice(beg.line.data[beg.boffset:end.boffset])
+	rel := v.cursor.boffset - beg.boffset
+
+	c := beg
+	if forward {
+		c = end
+	}
+	for {
+		var found bool
+		if forward {
+			c, found = c.search_forward(word)
+		} else {
+			c, found = c.search_backward(word)
+		}
+		if !found {
+			v.ctx.set_status("No more occurrences of \"%s\"", word)
+			return
+		}
+		whole := c.is_whole_word(len(word))
+		loc := c
+		loc.boffset += rel
+		if forward {
+			c.boffset += len(word)
+		}
+		if !whole || v.cursor_index(loc) != -1 {
+			continue
+		}
+		v.cursors = append(v.cursors, v.primary_cursor())
+		v.move_cursor_to(loc)
+		v.dirty = dirty_everything
+		v.report_cursors()
+		return
+	}
+}
+
+// Adds an extra cursor to every line between the cursor and the mark, at the
+// same visual offset as the cursor or at the end of shorter lines.
+func (v *view) add_cursors_to_region_lines() {
+	if !v.buf.is_mark_set() {
+		v.ctx.set_status("The mark is not set now, so there is no region")
+		return
+	}
+	c1, c2 := v.cursor, v.buf.mark
+	if c1.line_num > c2.line_num {
+		c1, c2 = c2, c1
+	}
+	c := cursor_location{c1.line, c1.line_num, 0}
+	for ; c.line_num <= c2.line_num; c.line, c.line_num = c.line.next, c.line_num+1 {
+		if c.line == v.cursor.line {
+			continue
+		}
+		c.boffset, _, _ = c.line.find_closest_offsets(v.cursor_voffset)
+		if v.cursor_index(c) == -1 {
+			v.cursors = append(v.cursors, extra_cursor{c, v.last_cursor_voffset, cursor_location{}})
+		}
+	}
+	v.dirty = dirty_everything
+	v.report_cursors()
+}
+
+func (v *view) draw_extra_cursors() {
+	for _, c := range v.cursors {
+		x, y := v.cursor_position_for(c.cursor_location)
+		if c.line != v.cursor.line {
+			x += v.line_voffset
+		}
+		if x < 0 || x >= v.uibuf.Width || y < 0 || y >= v.height() {
+			continue
+		}
+		cell := &v.uibuf.Cells[y*v.uibuf.Width+x]
+		cell.Fg |= termbox.AttrReverse
+	}
+}
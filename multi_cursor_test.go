@@ -0,0 +1,85 @@
+package main
+
+import "testing"
+
+func TestMultipleCursors(t *testing.T) {
+	v := new_test_view("foo = 1\nbar = foo\nfood = foo\n")
+	v.resize(40, 10)
+	check := func(what, want string) {
+		if got := string(v.buf.contents()); got != want {
+			t.Fatalf("%s: got %q, want %q", what, got, want)
+		}
+	}
+
+	// "food" is not the same word
+	v.add_cursor_at_word(true)
+	v.add_cursor_at_word(true)
+	v.add_cursor_at_word(true)
+	if len(v.cursors) != 2 {
+		t.Fatalf("got %d extra cursors, want 2", len(v.cursors))
+	}
+	if v.cursor.line_num != 3 || v.cursor.boffset != 7 {
+		t.Fatalf("cursor at %d:%d", v.cursor.line_num, v.cursor.boffset)
+	}
+
+	v.on_vcommand(vcommand_kill_word, 0)
+	v.on_vcommand(vcommand_insert_rune, 'x')
+	v.on_vcommand(vcommand_insert_rune, 'y')
+	check("edit", "xy = 1\nbar = xy\nfood = xy\n")
+	if string(v.ctx.kill_ring.head()) != "foo" || len(v.ctx.kill_ring.entries) != 1 {
+		t.Errorf("unexpected kill ring %q", v.ctx.kill_ring.entries)
+	}
+
+	v.on_vcommand(vcommand_move_cursor_beginning_of_line, 0)
+	v.on_vcommand(vcommand_insert_rune, '>')
+	check("beginning of line", ">xy = 1\n>bar = xy\n>food = xy\n")
+
+	// moving to the same place merges the cursors
+	v.on_vcommand(vcommand_move_cursor_prev_line, 0)
+	v.on_vcommand(vcommand_move_cursor_prev_line, 0)
+	v.on_vcommand(vcommand_move_cursor_prev_line, 0)
+	if len(v.cursors) != 0 {
+		t.Errorf("got %d extra cursors after merging", len(v.cursors))
+	}
+
+	v.on_vcommand(vcommand_undo, 0)
+	check("undo", "xy = 1\nbar = xy\nfood = xy\n")
+	v.on_vcommand(vcommand_undo, 0)
+	check("undo", " = 1\nbar = \nfood = \n")
+	v.on_vcommand(vcommand_undo, 0)
+	check("undo", "foo = 1\nbar = foo\nfood = foo\n")
+}
+
+func TestCursorsOnRegionLines(t *testing.T) {
+	v := new_test_view("a\nbbbb\ncc\ndddd\n")
+	v.buf.mark = v.buf.location_at(1, 0)
+	v.move_cursor_to(v.buf.location_at(4, 3))
+	v.add_cursors_to_region_lines()
+	v.on_vcommand(vcommand_insert_rune, '|')
+	if got := string(v.buf.contents()); got != "a|\nbbb|b\ncc|\nddd|d\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestYankPopAtCursors(t *testing.T) {
+	for _, extra_line := range []int{1, 2} {
+		v := new_test_view("foo\nfoo\n")
+		v.ctx.kill_ring.push([]byte("OLD"))
+		v.ctx.kill_ring.push([]byte("NEW"))
+		v.move_cursor_to(v.buf.location_at(3-extra_line, 0))
+		v.toggle_cursor(v.buf.location_at(extra_line, 0))
+
+		v.on_vcommand(vcommand_yank, 0)
+		if got := string(v.buf.contents()); got != "NEWfoo\nNEWfoo\n" {
+			t.Fatalf("extra cursor on line %d, yank: %q", extra_line, got)
+		}
+		v.on_vcommand(vcommand_yank_pop, 0)
+		if got := string(v.buf.contents()); got != "OLDfoo\nOLDfoo\n" {
+			t.Fatalf("extra cursor on line %d, yank-pop: %q", extra_line, got)
+		}
+		v.on_vcommand(vcommand_yank_pop, 0)
+		if got := string(v.buf.contents()); got != "NEWfoo\nNEWfoo\n" {
+			t.Fatalf("extra cursor on line %d, second yank-pop: %q", extra_line, got)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"unicode/utf8"
+
+	"github.com/nsf/termbox-go"
+)
+
+//----------------------------------------------------------------------------
+// bracketed paste
+//
+// With bracketed paste mode on, the terminal wraps pasted text in
+// "ESC [ 200 ~" and "ESC [ 201 ~". termbox doesn't know these sequences and
+// reports them as M-[ followed by the characters, so the key events are
+// watched for them here. Everything in between is collected and inserted with
+// a single action, it never reaches the key handlers and keyboard macros.
+//----------------------------------------------------------------------------
+
+var (
+	paste_begin = []rune("200~")
+	paste_end   = []rune("201~")
+)
+
+func set_bracketed_paste(on bool) {
+	if on {
+		write_to_terminal([]byte("\x1b[?2004h"))
+	} else {
+		write_to_terminal([]byte("\x1b[?2004l"))
+	}
+}
+
+type paste_state struct {
+	active  bool
+	pending []termbox.Event // what might be the start of a marker
+	data    []byte
+	cr      bool // the last pasted character was '\r'
+}
+
+const (
+	marker_mismatch = iota
+	marker_partial
+	marker_complete
+)
+
+func paste_marker_match(events []termbox.Event, tail []rune) int {
+	for i, ev := range events {
+		if i == 0 {
+			if ev.Mod != termbox.ModAlt || ev.Ch != '[' {
+				return marker_mismatch
+			}
+			continue
+		}
+		if i > len(tail) || ev.Mod != 0 || ev.Ch != tail[i-1] {
+			return marker_mismatch
+		}
+	}
+	if len(events) == len(tail)+1 {
+		return marker_complete
+	}
+	return marker_partial
+}
+
+// Converts a key event of pasted text back to what the terminal got.
+func (p *paste_state) add(ev termbox.Event) {
+	cr := p.cr
+	p.cr = false
+	if ev.Mod&termbox.ModAlt != 0 {
+		// termbox took the escape character for the alt modifier
+		p.data = append(p.data, '\x1b')
+	}
+	switch {
+	case ev.Ch != 0:
+		var buf [utf8.UTFMax]byte
+		p.data = append(p.data, buf[:utf8.EncodeRune(buf[:], ev.Ch)]...)
+	case ev.Key == termbox.KeyEnter:
+		// terminals send newlines as '\r'
+		p.data = append(p.data, '\n')
+		p.cr = true
+	case ev.Key == termbox.KeyCtrlJ:
+		if !cr {
+			p.data = append(p.data, '\n')
+		}
+	case ev.Key <= termbox.KeySpace || ev.Key == termbox.KeyBackspace2:
+		p.data = append(p.data, byte(ev.Key))
+	}
+}
+
+// Takes a key event and returns the ones which are to be handled as usual,
+// events may be held back until it's clear whether they start a marker.
+func (g *godit) filter_paste(ev termbox.Event) []termbox.Event {
+	p := &g.paste
+	if len(p.pending) == 0 && (ev.Mod != termbox.ModAlt || ev.Ch != '[') {
+		if p.active {
+			p.add(ev)
+			return nil
+		}
+		return []termbox.Event{ev}
+	}
+
+	p.pending = append(p.pending, ev)
+	marker := paste_begin
+	if p.active {
+		marker = paste_end
+	}
+	switch paste_marker_match(p.pending, marker) {
+	case marker_partial:
+		return nil
+	case marker_complete:
+		p.pending = p.pending[:0]
+		if p.active {
+			g.paste_text(p.data)
+			p.data = nil
+		}
+		p.active = !p.active
+		p.cr = false
+		return nil
+	}
+
+	// not a marker after all
+	events := p.pending
+	p.pending = nil
+	if p.active {
+		for _, ev := range events {
+			p.add(ev)
+		}
+		return nil
+	}
+	return events
+}
+
+func (g *godit) paste_text(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	if g.overlay != nil {
+		// prompts get the first line, as if it was typed
+		for _, r := range string(data) {
+			if r == '\n' {
+				break
+			}
+			ev := termbox.Event{Type: termbox.EventKey, Ch: r}
+			switch r {
+			case ' ':
+				ev = termbox.Event{Type: termbox.EventKey, Key: termbox.KeySpace}
+			case '\t':
+				ev = termbox.Event{Type: termbox.EventKey, Key: termbox.KeyTab}
+			}
+			g.overlay.on_key(&ev)
+			if g.overlay == nil {
+				break
+			}
+		}
+		return
+	}
+
+	v := g.active.leaf
+	if v.buf.readonly {
+		g.set_status("%s", err_readonly_buffer)
+		return
+	}
+	v.ac = nil
+	v.finalize_action_group()
+	c := v.cursor
+	v.action_insert(c, data)
+	c.move_n_bytes_forward(data)
+	v.move_cursor_to(c)
+	v.finalize_action_group()
+	v.last_vcommand = vcommand_none
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+import termbox "github.com/nsf/termbox-go"
+
+func TestBracketedPaste(t *testing.T) {
+	// keep away from the places file of the user
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	g := new_godit(nil)
+	var events []termbox.Event
+	marker := func(tail string) {
+		events = append(events, termbox.Event{Type: termbox.EventKey, Mod: termbox.ModAlt, Ch: '['})
+		for _, r := range tail {
+			events = append(events, termbox.Event{Type: termbox.EventKey, Ch: r})
+		}
+	}
+	key := func(k termbox.Key) {
+		events = append(events, termbox.Event{Type: termbox.EventKey, Key: k})
+	}
+
+	marker("200~")
+	events = append(events, termbox.Event{Type: termbox.EventKey, Ch: 'a'})
+	key(termbox.KeyEnter)
+	key(termbox.KeyCtrlJ)
+	key(termbox.KeyTab)
+	// looks like a marker at first
+	marker("2x")
+	marker("201~")
+	// M-[ is not bound, so only the 'x' is typed
+	marker("x")
+
+	for _, ev := range events {
+		g.handle_event(&ev)
+	}
+	v := g.active.leaf
+	if got := string(v.buf.contents()); got != "a\n\t\x1b[2xx" {
+		t.Fatalf("buffer contains %q", got)
+	}
+
+	// the typed 'x' and the whole paste
+	v.on_vcommand(vcommand_undo, 0)
+	v.on_vcommand(vcommand_undo, 0)
+	if got := string(v.buf.contents()); got != "" {
+		t.Fatalf("buffer contains %q after undoing the paste", got)
+	}
+}
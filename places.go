@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//----------------------------------------------------------------------------
+// places
+//
+// The last location in every visited file is remembered, so that reopening
+// the file brings the cursor back where it was. The list is ordered by the
+// time the files were last opened and doubles as the recent files list. It's
+// written when a buffer is killed and on exit, merged with what other
+// instances of the editor have written in the meantime.
+//----------------------------------------------------------------------------
+
+const places_max = 3000
+
+type file_place struct {
+	Path     string
+	Location session_location
+}
+
+func places_path() string {
+	return cache_dir("places")
+}
+
+func read_places(filename string) []file_place {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+	var places []file_place
+	if err := json.Unmarshal(data, &places); err != nil {
+		return nil
+	}
+	return places
+}
+
+// Puts 'p' to the front of 'places', replacing the older entry for the same
+// path.
+func add_place(places []file_place, p file_place) []file_place {
+	for i := range places {
+		if places[i].Path == p.Path {
+			copy(places[1:i+1], places[:i])
+			places[0] = p
+			return places
+		}
+	}
+	places = append(places, file_place{})
+	copy(places[1:], places)
+	places[0] = p
+	return places
+}
+
+// Entries of 'ours' go first, followed by the ones only 'theirs' knows about.
+func merge_places(ours, theirs []file_place) []file_place {
+	seen := make(map[string]bool, len(ours))
+	merged := make([]file_place, 0, len(ours)+len(theirs))
+	for _, list := range [][]file_place{ours, theirs} {
+		for _, p := range list {
+			if seen[p.Path] {
+				continue
+			}
+			seen[p.Path] = true
+			merged = append(merged, p)
+		}
+	}
+	if len(merged) > places_max {
+		merged = merged[:places_max]
+	}
+	return merged
+}
+
+func (g *godit) find_place(path string) (file_place, bool) {
+	for _, p := range g.places {
+		if p.Path == path {
+			return p, true
+		}
+	}
+	return file_place{}, false
+}
+
+// Moves the file to the front of the recent files and returns the place it
+// was left at last time.
+func (g *godit) visit_place(path string) (file_place, bool) {
+	p, ok := g.find_place(path)
+	if !ok {
+		p = file_place{Path: path}
+	}
+	g.places = add_place(g.places, p)
+	return p, ok
+}
+
+// Records the locations of the buffers and writes the places file.
+func (g *godit) remember_places(bufs ...*buffer) {
+	for _, buf := range bufs {
+		if buf.path == "" || buf.keymap != nil {
+			continue
+		}
+		loc := buf.loc
+		if len(buf.views) > 0 {
+			loc = buf.views[0].view_location
+		}
+		p := file_place{buf.path, make_session_location(&loc)}
+		found := false
+		for i := range g.places {
+			if g.places[i].Path == buf.path {
+				g.places[i] = p
+				found = true
+				break
+			}
+		}
+		if !found {
+			g.places = add_place(g.places, p)
+		}
+	}
+
+	filename := places_path()
+	g.places = merge_places(g.places, read_places(filename))
+	data, err := json.Marshal(g.places)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return
+	}
+	atomic_write_file(filename, data)
+}
+
+func (g *godit) recent_files_ac(view *view) ([]ac_proposal, int) {
+	pattern := string(view.buf.contents()[:view.cursor.boffset])
+	proposals := make([]ac_proposal, 0, 20)
+	for _, p := range g.places {
+		if !strings.Contains(p.Path, pattern) {
+			continue
+		}
+		if _, err := os.Stat(disk_path(p.Path)); err != nil {
+			continue
+		}
+		proposals = append(proposals, ac_proposal{
+			display: []byte(p.Path),
+			content: []byte(p.Path),
+		})
+	}
+	return proposals, view.cursor_coffset
+}
+
+// "lemp" stands for "line edit mode params"
+func (g *godit) recent_files_lemp() line_edit_mode_params {
+	return line_edit_mode_params{
+		ac_decide: func(*view) ac_func {
+			return g.recent_files_ac
+		},
+		prompt:         "Recent file:",
+		init_autocompl: true,
+
+		on_apply: func(linebuf *buffer) {
+			path := string(linebuf.contents())
+			if path == "" {
+				g.set_status("(Nothing to open)")
+				return
+			}
+			buf, err := g.new_buffer_from_file(path)
+			if err != nil {
+				return
+			}
+			g.active.leaf.push_jump()
+			g.active.leaf.attach(buf)
+			g.offer_recovery()
+		},
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestPlaces(t *testing.T) {
+	paths := func(places []file_place) string {
+		s := ""
+		for _, p := range places {
+			s += p.Path
+		}
+		return s
+	}
+
+	var places []file_place
+	for _, path := range []string{"a", "b", "c", "b"} {
+		places = add_place(places, file_place{Path: path})
+	}
+	if got := paths(places); got != "bca" {
+		t.Fatalf("recent files are %q, want \"bca\"", got)
+	}
+
+	ours := []file_place{{Path: "a", Location: session_location{TopLine: 5}}, {Path: "b"}}
+	theirs := []file_place{{Path: "d"}, {Path: "a"}, {Path: "e"}}
+	merged := merge_places(ours, theirs)
+	if got := paths(merged); got != "abde" {
+		t.Fatalf("merged places are %q, want \"abde\"", got)
+	}
+	if merged[0].Location.TopLine != 5 {
+		t.Fatal("merged place is not ours")
+	}
+}
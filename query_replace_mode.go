@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/nsf/termbox-go"
+)
+
+//----------------------------------------------------------------------------
+// query replace mode
+//
+// Steps through the matches in the region, or in the whole buffer when the
+// mark is not set, and asks what to do with each one. The regexp variant
+// expands "\1" and "${name}" in the replacement to the capture groups. All the
+// replacements go to a single action group. Matches are found in the text of
+// the buffer with lines joined by '\n' (see regexp_search.go), positions are
+// absolute byte offsets into it.
+//----------------------------------------------------------------------------
+
+const query_replace_help = "(y or <space>: replace, n or <backspace>: skip, " +
+	"!: replace all, .: replace and quit, ^: back, q or <enter>: quit)"
+
+type query_replace_step struct {
+	offset   int
+	original []byte
+	repl_len int // -1 when the match was skipped
+}
+
+type query_replace_mode struct {
+	stub_overlay_mode
+	godit  *godit
+	view   *view
+	re     *regexp.Regexp
+	repl   []byte
+	regexp bool
+
+	data  []byte // the text of the buffer, updated after each replacement
+	pos   int    // where to look for the next match
+	limit int    // the end of the region
+	match []int  // the current one, nil when there are no more
+	steps []query_replace_step
+
+	replaced int
+	prompt   string
+}
+
+// Returns nil when there is nothing to replace.
+func init_query_replace_mode(g *godit, re *regexp.Regexp, word, repl []byte, is_regexp bool) overlay_mode {
+	v := g.active.leaf
+	m := &query_replace_mode{
+		godit:  g,
+		view:   v,
+		re:     re,
+		repl:   repl,
+		regexp: is_regexp,
+		data:   v.buf.joined_lines(),
+	}
+	if is_regexp {
+		m.repl = convert_backrefs(repl)
+	}
+	if v.buf.is_mark_set() {
+		beg, end := swap_cursors_maybe(v.cursor, v.buf.mark)
+		m.pos = make_cursor_location_ex(beg).abs_boffset
+		m.limit = make_cursor_location_ex(end).abs_boffset
+	} else {
+		m.limit = len(m.data)
+	}
+	what := "Query replacing"
+	if is_regexp {
+		what = "Query replacing regexp"
+	}
+	m.prompt = fmt.Sprintf("%s %s with %s: %s", what, word, repl, query_replace_help)
+
+	if !m.next() {
+		g.set_status("No matches for %s", word)
+		return nil
+	}
+	v.finalize_action_group()
+	v.highlight_regexp = re
+	return m
+}
+
+// Converts "\N" references to capture groups to the "${N}" form understood by
+// regexp.Expand, "\\" stands for a backslash. A '$' which doesn't start
+// "${name}" is escaped, it's taken literally.
+func convert_backrefs(repl []byte) []byte {
+	var out []byte
+	for i := 0; i < len(repl); i++ {
+		c := repl[i]
+		if c == '$' && (i+1 == len(repl) || repl[i+1] != '{') {
+			out = append(out, "$$"...)
+			continue
+		}
+		if c == '\\' && i+1 < len(repl) {
+			n := repl[i+1]
+			switch {
+			case n >= '0' && n <= '9':
+				out = append(out, "${"...)
+				out = append(out, n, '}')
+				i++
+				continue
+			case n == '\\':
+				out = append(out, '\\')
+				i++
+				continue
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// The text which replaces the current match.
+func (m *query_replace_mode) replacement() []byte {
+	if !m.regexp {
+		return m.repl
+	}
+	return m.re.Expand(nil, m.repl, m.data, m.match)
+}
+
+// Finds the next match and shows it, returns false when there are no more.
+func (m *query_replace_mode) next() bool {
+	m.match = nil
+	if m.pos <= m.limit {
+		match, ok := regexp_search_forward(m.data, m.re, m.pos, nil)
+		if ok && match[1] <= m.limit {
+			m.match = match
+		}
+	}
+	if m.match == nil {
+		return false
+	}
+
+	v := m.view
+	b := v.buf
+	beg, end := b.offset_to_cursor(m.match[0]), b.offset_to_cursor(m.match[1])
+	v.set_tags(view_tag{
+		beg_line:   beg.line_num,
+		beg_offset: beg.boffset,
+		end_line:   end.line_num,
+		end_offset: end.boffset,
+		fg:         termbox.ColorCyan,
+		bg:         termbox.ColorMagenta,
+	})
+	v.move_cursor_to(end)
+	v.dirty = dirty_everything
+	m.godit.set_status("%s", m.prompt)
+	return true
+}
+
+// Moves past the current match, an empty one is stepped over as well.
+func (m *query_replace_mode) advance(match_end int) {
+	m.pos = match_end
+	if m.match[0] == m.match[1] {
+		m.pos++
+	}
+}
+
+func (m *query_replace_mode) replace() {
+	v := m.view
+	b := v.buf
+	beg := m.match[0]
+	original := clone_byte_slice(m.data[beg:m.match[1]])
+	repl := m.replacement()
+
+	c := b.offset_to_cursor(beg)
+	if len(original) > 0 {
+		v.action_delete(c, len(original))
+	}
+	if len(repl) > 0 {
+		v.action_insert(c, clone_byte_slice(repl))
+	}
+	m.steps = append(m.steps, query_replace_step{beg, original, len(repl)})
+	m.replaced++
+
+	m.data = splice_bytes(m.data, beg, m.match[1], repl)
+	m.limit += len(repl) - len(original)
+	m.advance(beg + len(repl))
+}
+
+// Replaces data[beg:end] with 'repl' in place, growing 'data' when needed.
+func splice_bytes(data []byte, beg, end int, repl []byte) []byte {
+	old := len(data)
+	n := old - (end - beg) + len(repl)
+	if n > old {
+		data = append(data, make([]byte, n-old)...)
+	}
+	copy(data[beg+len(repl):n], data[end:old])
+	copy(data[beg:], repl)
+	return data[:n]
+}
+
+func (m *query_replace_mode) skip() {
+	m.steps = append(m.steps, query_replace_step{m.match[0], nil, -1})
+	m.advance(m.match[1])
+}
+
+// Goes back to the previous match, its replacement is reverted.
+func (m *query_replace_mode) back() {
+	if len(m.steps) == 0 {
+		m.godit.set_status("No previous match")
+		return
+	}
+	s := m.steps[len(m.steps)-1]
+	m.steps = m.steps[:len(m.steps)-1]
+	if s.repl_len >= 0 {
+		v := m.view
+		c := v.buf.offset_to_cursor(s.offset)
+		if s.repl_len > 0 {
+			v.action_delete(c, s.repl_len)
+		}
+		if len(s.original) > 0 {
+			v.action_insert(c, s.original)
+		}
+		m.replaced--
+		m.data = splice_bytes(m.data, s.offset, s.offset+s.repl_len, s.original)
+		m.limit += len(s.original) - s.repl_len
+	}
+	m.pos = s.offset
+	m.next()
+	m.godit.set_status("%s", m.prompt)
+}
+
+func (m *query_replace_mode) exit() {
+	v := m.view
+	v.set_tags()
+	v.highlight_regexp = nil
+	v.finalize_action_group()
+	v.last_vcommand = vcommand_none
+	v.dirty = dirty_everything
+	m.godit.set_status("Replaced %d occurrence(s)", m.replaced)
+}
+
+func (m *query_replace_mode) on_key(ev *termbox.Event) {
+	g := m.godit
+	ch := ev.Ch
+	switch ev.Key {
+	case termbox.KeySpace:
+		ch = 'y'
+	case termbox.KeyBackspace, termbox.KeyBackspace2, termbox.KeyDelete:
+		ch = 'n'
+	case termbox.KeyEnter, termbox.KeyCtrlJ:
+		ch = 'q'
+	}
+	if ev.Mod != 0 {
+		ch = 0
+	}
+
+	switch ch {
+	case 'y':
+		m.replace()
+		if !m.next() {
+			g.set_overlay_mode(nil)
+		}
+	case 'n':
+		m.skip()
+		if !m.next() {
+			g.set_overlay_mode(nil)
+		}
+	case '!':
+		for {
+			m.replace()
+			if !m.next() {
+				break
+			}
+		}
+		g.set_overlay_mode(nil)
+	case '.':
+		m.replace()
+		g.set_overlay_mode(nil)
+	case '^':
+		m.back()
+	case 'q':
+		g.set_overlay_mode(nil)
+	default:
+		// any other key quits and does what it does normally
+		g.set_overlay_mode(nil)
+		g.on_key(ev)
+	}
+}
+
+//----------------------------------------------------------------------------
+// query replace prompts
+//----------------------------------------------------------------------------
+
+// "lemp" stands for "line edit mode params"
+func (g *godit) query_replace_lemp1(is_regexp bool) line_edit_mode_params {
+	last_word, what := &g.s_and_r_last_word, "Query replace"
+	if is_regexp {
+		last_word, what = &g.s_and_r_last_regexp, "Query replace regexp"
+	}
+	prompt := what + ":"
+	if len(*last_word) != 0 {
+		prompt = fmt.Sprintf("%s [%s]:", what, *last_word)
+	}
+	return line_edit_mode_params{
+		prompt: prompt,
+		on_apply: func(buf *buffer) {
+			word := buf.contents()
+			if len(word) == 0 {
+				word = *last_word
+			}
+			if len(word) == 0 {
+				g.set_status("Nothing to replace")
+				return
+			}
+			pattern := string(word)
+			if !is_regexp {
+				pattern = regexp.QuoteMeta(pattern)
+			}
+			re, err := compile_search_regexp(pattern)
+			if err != nil {
+				g.set_status("%s", err)
+				return
+			}
+			g.set_overlay_mode(init_line_edit_mode(g, g.query_replace_lemp2(re, word, is_regexp)))
+		},
+	}
+}
+
+// "lemp" stands for "line edit mode params"
+func (g *godit) query_replace_lemp2(re *regexp.Regexp, word []byte, is_regexp bool) line_edit_mode_params {
+	last_word, last_repl, what := &g.s_and_r_last_word, &g.s_and_r_last_repl, "Query replace"
+	if is_regexp {
+		last_word, last_repl, what = &g.s_and_r_last_regexp, &g.s_and_r_last_regexp_repl, "Query replace regexp"
+	}
+	prompt := fmt.Sprintf("%s %s with:", what, word)
+	if len(*last_repl) != 0 {
+		prompt = fmt.Sprintf("%s %s with [%s]:", what, word, *last_repl)
+	}
+	return line_edit_mode_params{
+		prompt: prompt,
+		on_apply: func(buf *buffer) {
+			repl := buf.contents()
+			if len(repl) == 0 {
+				repl = *last_repl
+			}
+			*last_word = word
+			*last_repl = repl
+			if g.active.leaf.buf.readonly {
+				g.set_status("%s", err_readonly_buffer)
+				return
+			}
+			g.set_overlay_mode(init_query_replace_mode(g, re, word, repl, is_regexp))
+		},
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import "bytes"
+import "io/ioutil"
+import "path/filepath"
+import "testing"
+import termbox "github.com/nsf/termbox-go"
+
+func TestConvertBackrefs(t *testing.T) {
+	got := string(convert_backrefs([]byte(`\2-\1 \\1 ${name} \x`)))
+	if want := `${2}-${1} \1 ${name} \x`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// a bare '$' is literal
+	re, _ := compile_search_regexp(`(\d+)`)
+	src := []byte("5")
+	m := re.FindSubmatchIndex(src)
+	for repl, want := range map[string]string{
+		`\1$USD`:   "5$USD",
+		`$\1 each`: "$5 each",
+	} {
+		got := string(re.Expand(nil, convert_backrefs([]byte(repl)), src, m))
+		if got != want {
+			t.Errorf("%s expanded to %q, want %q", repl, got, want)
+		}
+	}
+}
+
+func TestQueryReplace(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	path := filepath.Join(t.TempDir(), "a.go")
+	ioutil.WriteFile(path, []byte("a := f(1)\nb := f(2)\nc := f(3)\nd := f(4)\n"), 0644)
+
+	g := new_godit([]string{path})
+	v := g.active.leaf
+	press := func(keys string) {
+		for _, ch := range keys {
+			if g.overlay == nil {
+				t.Fatalf("query replace quit before %q", ch)
+			}
+			g.overlay.on_key(&termbox.Event{Type: termbox.EventKey, Ch: ch})
+		}
+	}
+	contents := func() string {
+		return string(v.buf.contents())
+	}
+	// the text matched against must follow the replacements
+	in_sync := func() {
+		m, ok := g.overlay.(*query_replace_mode)
+		if ok && !bytes.Equal(m.data, v.buf.joined_lines()) {
+			t.Fatalf("matching against %q, buffer has %q", m.data, v.buf.joined_lines())
+		}
+	}
+
+	re, _ := compile_search_regexp(`(?P<fn>f)\((\d)\)`)
+	g.set_overlay_mode(init_query_replace_mode(g, re, []byte("pattern"), []byte(`${fn}(\2\2)`), true))
+	press("yn^")
+	in_sync()
+	if got := contents(); got != "a := f(11)\nb := f(2)\nc := f(3)\nd := f(4)\n" {
+		t.Fatalf("after going back to a skipped match: %q", got)
+	}
+	press("^")
+	in_sync()
+	if got := contents(); got != "a := f(1)\nb := f(2)\nc := f(3)\nd := f(4)\n" {
+		t.Fatalf("after going back to a replaced match: %q", got)
+	}
+	press("yn!")
+	if g.overlay != nil {
+		t.Fatalf("still replacing after '!'")
+	}
+	if got := contents(); got != "a := f(11)\nb := f(2)\nc := f(33)\nd := f(44)\n" {
+		t.Fatalf("after replacing all: %q", got)
+	}
+
+	// one undo reverts all the replacements
+	v.on_vcommand(vcommand_undo, 0)
+	if got := contents(); got != "a := f(1)\nb := f(2)\nc := f(3)\nd := f(4)\n" {
+		t.Fatalf("after undo: %q", got)
+	}
+
+	// literal replacement within the region, '$' is not special
+	v.buf.mark = v.buf.location_at(2, 0)
+	v.move_cursor_to(v.buf.location_at(3, 9))
+	re, _ = compile_search_regexp(`:=`)
+	g.set_overlay_mode(init_query_replace_mode(g, re, []byte(":="), []byte("$1 ="), false))
+	press("yy")
+	if g.overlay != nil {
+		t.Fatalf("still replacing after the end of the region")
+	}
+	if got := contents(); got != "a := f(1)\nb $1 = f(2)\nc $1 = f(3)\nd := f(4)\n" {
+		t.Fatalf("literal replacement: %q", got)
+	}
+}
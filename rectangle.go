@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+//----------------------------------------------------------------------------
+// rectangles
+//
+// The rectangle is the block of columns between the cursor and the mark, on
+// all the lines from one to the other. Columns are visual offsets, so a tab
+// crossing an edge of the rectangle is replaced with spaces before the text is
+// cut there. Killed rectangles don't go to the kill ring, the last one is kept
+// separately and is yanked with its upper left corner at the cursor.
+//----------------------------------------------------------------------------
+
+type rectangle struct {
+	first       cursor_location // the beginning of the top line
+	lines       int
+	left, right int // visual offsets, 'right' is exclusive
+}
+
+func (v *view) rectangle() (rectangle, bool) {
+	if !v.buf.is_mark_set() {
+		v.ctx.set_status("The mark is not set now, so there is no region")
+		return rectangle{}, false
+	}
+	c1, c2 := v.cursor, v.buf.mark
+	if c1.line_num > c2.line_num {
+		c1, c2 = c2, c1
+	}
+	r := rectangle{
+		first: cursor_location{c1.line, c1.line_num, 0},
+		lines: c2.line_num - c1.line_num + 1,
+		left:  c1.voffset(),
+		right: c2.voffset(),
+	}
+	if r.left > r.right {
+		r.left, r.right = r.right, r.left
+	}
+	return r, true
+}
+
+// Returns the part of 'data' between the visual offsets 'left' and 'right'.
+// Tabs are expanded to spaces, so that the text keeps its shape wherever it's
+// yanked, short lines are padded with spaces.
+func rectangle_line(data []byte, left, right int) []byte {
+	out := make([]byte, 0, right-left)
+	vo := 0
+	for len(data) > 0 && vo < right {
+		r, rlen := decode_rune(data)
+		adv := rune_advance_len(r, vo)
+		switch {
+		case vo >= left && vo+adv <= right && r != '\t':
+			out = append(out, data[:rlen]...)
+		case vo+adv > left:
+			// a tab, or a character which is partially outside
+			n := vo + adv
+			if n > right {
+				n = right
+			}
+			if vo > left {
+				n -= vo
+			} else {
+				n -= left
+			}
+			out = append(out, bytes.Repeat([]byte{' '}, n)...)
+		}
+		vo += adv
+		data = data[rlen:]
+	}
+	if vo < left {
+		vo = left
+	}
+	if vo < right {
+		out = append(out, bytes.Repeat([]byte{' '}, right-vo)...)
+	}
+	return out
+}
+
+// Returns the byte offset of the visual offset 'col' in the line of 'c'. A tab
+// which covers the column is replaced with spaces. When the line is shorter,
+// it's padded with spaces if 'pad' is set, otherwise its length is returned.
+// Other wide characters can't be split, the offset before them is returned.
+func (v *view) rectangle_column(c cursor_location, col int, pad bool) int {
+	bo, _, vo := c.line.find_closest_offsets(col)
+	c.boffset = bo
+	switch {
+	case vo == col:
+	case bo == len(c.line.data):
+		if pad {
+			v.action_insert(c, bytes.Repeat([]byte{' '}, col-vo))
+			bo += col - vo
+		}
+	case c.line.data[bo] == '\t':
+		adv := rune_advance_len('\t', vo)
+		v.action_delete(c, 1)
+		v.action_insert(c, bytes.Repeat([]byte{' '}, adv))
+		bo += col - vo
+	}
+	return bo
+}
+
+// Calls 'fn' for every line of the rectangle with 'c' at its left edge and the
+// byte offset of its right edge, 'pad' is passed on to 'rectangle_column' for
+// the left edge.
+func (v *view) each_rectangle_line(r rectangle, pad bool, fn func(c cursor_location, end int)) {
+	c := r.first
+	for i := 0; i < r.lines; i++ {
+		c.boffset = v.rectangle_column(c, r.left, pad)
+		end := v.rectangle_column(c, r.right, false)
+		fn(c, end)
+		c.line = c.line.next
+		c.line_num++
+	}
+}
+
+func (v *view) extract_rectangle(r rectangle) [][]byte {
+	rows := make([][]byte, 0, r.lines)
+	line := r.first.line
+	for i := 0; i < r.lines; i++ {
+		rows = append(rows, rectangle_line(line.data, r.left, r.right))
+		line = line.next
+	}
+	return rows
+}
+
+// Moves the cursor to the upper left corner of the rectangle.
+func (v *view) move_cursor_to_rectangle(r rectangle) {
+	c := r.first
+	c.boffset, _, _ = c.line.find_closest_offsets(r.left)
+	v.move_cursor_to(c)
+}
+
+func (v *view) delete_rectangle(r rectangle) {
+	v.each_rectangle_line(r, false, func(c cursor_location, end int) {
+		if end > c.boffset {
+			v.action_delete(c, end-c.boffset)
+		}
+	})
+	v.move_cursor_to_rectangle(r)
+}
+
+// Inserts blank space in the rectangle, the text in it is shifted right.
+func (v *view) open_rectangle(r rectangle) {
+	spaces := bytes.Repeat([]byte{' '}, r.right-r.left)
+	v.each_rectangle_line(r, false, func(c cursor_location, end int) {
+		if c.voffset() < r.left {
+			// too short to be affected, don't add trailing spaces
+			return
+		}
+		v.action_insert(c, clone_byte_slice(spaces))
+	})
+	v.move_cursor_to_rectangle(r)
+}
+
+// Replaces the contents of the rectangle on each line with 'data'.
+func (v *view) string_rectangle(r rectangle, data []byte) {
+	v.each_rectangle_line(r, true, func(c cursor_location, end int) {
+		if end > c.boffset {
+			v.action_delete(c, end-c.boffset)
+		}
+		v.action_insert(c, clone_byte_slice(data))
+	})
+	v.move_cursor_to_rectangle(r)
+}
+
+// Inserts line numbers, starting from 1, at the left edge of the rectangle.
+func (v *view) number_rectangle(r rectangle) {
+	width := len(strconv.Itoa(r.lines))
+	n := 0
+	v.each_rectangle_line(r, true, func(c cursor_location, end int) {
+		n++
+		v.action_insert(c, []byte(fmt.Sprintf("%*d ", width, n)))
+	})
+	v.move_cursor_to_rectangle(r)
+}
+
+// Inserts 'rows' with the upper left corner at the cursor, lines are added at
+// the end of the buffer when needed. The mark is left at the upper left
+// corner and the cursor at the lower right one.
+func (v *view) yank_rectangle(rows [][]byte) {
+	start := v.cursor
+	col := start.voffset()
+	c := start
+	for i, row := range rows {
+		if i > 0 {
+			if c.line.next == nil {
+				v.action_insert(cursor_location{c.line, c.line_num, len(c.line.data)}, []byte{'\n'})
+			}
+			c.line = c.line.next
+			c.line_num++
+		}
+		c.boffset = v.rectangle_column(c, col, true)
+		v.action_insert(c, clone_byte_slice(row))
+		c.boffset += len(row)
+	}
+	start.boffset, _, _ = start.line.find_closest_offsets(col)
+	v.buf.push_mark(start)
+	v.move_cursor_to(c)
+}
+
+//----------------------------------------------------------------------------
+// rectangle commands
+//----------------------------------------------------------------------------
+
+// Runs a rectangle command as a single undo step.
+func (g *godit) edit_rectangle(fn func(v *view, r rectangle)) {
+	v := g.active.leaf
+	if v.buf.readonly {
+		g.set_status("%s", err_readonly_buffer)
+		return
+	}
+	r, ok := v.rectangle()
+	if !ok {
+		return
+	}
+	v.finalize_action_group()
+	fn(v, r)
+	v.finalize_action_group()
+	v.last_vcommand = vcommand_none
+}
+
+func (g *godit) copy_rectangle() {
+	v := g.active.leaf
+	r, ok := v.rectangle()
+	if !ok {
+		return
+	}
+	g.rectangle = v.extract_rectangle(r)
+	g.set_status("Copied rectangle of %d lines", r.lines)
+}
+
+func (g *godit) kill_rectangle() {
+	g.edit_rectangle(func(v *view, r rectangle) {
+		g.rectangle = v.extract_rectangle(r)
+		v.delete_rectangle(r)
+	})
+}
+
+func (g *godit) yank_rectangle() {
+	if g.rectangle == nil {
+		g.set_status("No rectangle to yank")
+		return
+	}
+	v := g.active.leaf
+	if v.buf.readonly {
+		g.set_status("%s", err_readonly_buffer)
+		return
+	}
+	v.finalize_action_group()
+	v.yank_rectangle(g.rectangle)
+	v.finalize_action_group()
+	v.last_vcommand = vcommand_none
+}
+
+// "lemp" stands for "line edit mode params"
+func (g *godit) string_rectangle_lemp() line_edit_mode_params {
+	prompt := "String rectangle:"
+	if len(g.rectangle_string) != 0 {
+		prompt = fmt.Sprintf("String rectangle [%s]:", g.rectangle_string)
+	}
+	return line_edit_mode_params{
+		prompt: prompt,
+		on_apply: func(buf *buffer) {
+			if contents := buf.contents(); len(contents) != 0 {
+				g.rectangle_string = contents
+			}
+			g.edit_rectangle(func(v *view, r rectangle) {
+				v.string_rectangle(r, g.rectangle_string)
+			})
+		},
+	}
+}
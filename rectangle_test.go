@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestRectangleLine(t *testing.T) {
+	tests := []struct {
+		data        string
+		left, right int
+		want        string
+	}{
+		{"abcdef", 1, 4, "bcd"},
+		{"ab", 1, 4, "b  "},
+		{"", 1, 3, "  "},
+		{"a\tb", 2, 9, "      b"},
+		{"a\tb", 0, 3, "a  "},
+	}
+	for _, tt := range tests {
+		got := string(rectangle_line([]byte(tt.data), tt.left, tt.right))
+		if got != tt.want {
+			t.Errorf("%q [%d, %d): got %q, want %q", tt.data, tt.left, tt.right, got, tt.want)
+		}
+	}
+}
+
+func TestRectangleEditing(t *testing.T) {
+	v := new_test_view("one two\nx\tyz\nthree four\n")
+	check := func(what, want string) {
+		if got := string(v.buf.contents()); got != want {
+			t.Fatalf("%s: got %q, want %q", what, got, want)
+		}
+	}
+	set_region := func(l1, b1, l2, b2 int) {
+		v.buf.mark = v.buf.location_at(l1, b1)
+		v.move_cursor_to(v.buf.location_at(l2, b2))
+	}
+
+	// the tab on the second line crosses both edges
+	set_region(1, 2, 3, 4)
+	r, _ := v.rectangle()
+	rows := v.extract_rectangle(r)
+	v.delete_rectangle(r)
+	check("delete", "ontwo\nx     yz\nthe four\n")
+	if len(rows) != 3 || string(rows[1]) != "  " || string(rows[2]) != "re" {
+		t.Fatalf("unexpected rectangle %q", rows)
+	}
+
+	v.move_cursor_to(v.buf.location_at(1, 2))
+	v.yank_rectangle(rows)
+	check("yank", "one two\nx       yz\nthree four\n")
+
+	set_region(1, 0, 3, 0)
+	r, _ = v.rectangle()
+	v.number_rectangle(r)
+	check("number", "1 one two\n2 x       yz\n3 three four\n")
+
+	set_region(1, 2, 2, 5)
+	r, _ = v.rectangle()
+	v.string_rectangle(r, []byte("-"))
+	check("string", "1 - two\n2 -     yz\n3 three four\n")
+}
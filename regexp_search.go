@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+)
+
+//----------------------------------------------------------------------------
+// regexp search
+//
+// Regexps are matched against the whole text of the buffer with lines joined
+// by '\n', so matches may span lines. Absolute byte offsets into that text are
+// mapped to cursor locations with 'offset_to_cursor'. Patterns are compiled in
+// multi-line mode, '^' and '$' match at the beginning and the end of lines.
+//----------------------------------------------------------------------------
+
+func compile_search_regexp(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("(?m)" + pattern)
+}
+
+// Returns the text of the buffer, lines are joined by '\n' whatever the line
+// endings of the buffer are.
+func (b *buffer) joined_lines() []byte {
+	data := make([]byte, 0, b.bytes_n+b.lines_n)
+	for l := b.first_line; l != nil; l = l.next {
+		data = append(data, l.data...)
+		if l.next != nil {
+			data = append(data, '\n')
+		}
+	}
+	return data
+}
+
+// Returns the submatch indices of the first match which starts at 'from' or
+// after it and passes 'accept' (nil accepts any match). Matching starts at the
+// beginning of the line containing 'from', so that '^' and '\b' see the same
+// text around the match as they would when matching the whole buffer.
+func regexp_search_forward(data []byte, re *regexp.Regexp, from int, accept func([]int) bool) ([]int, bool) {
+	if from > len(data) {
+		return nil, false
+	}
+	ls := bytes.LastIndexByte(data[:from], '\n') + 1
+	for n := 16; ; n *= 2 {
+		matches := re.FindAllSubmatchIndex(data[ls:], n)
+		for _, m := range matches {
+			if ls+m[0] < from {
+				continue
+			}
+			m = shift_match(m, ls)
+			if accept == nil || accept(m) {
+				return m, true
+			}
+		}
+		if len(matches) < n {
+			return nil, false
+		}
+	}
+}
+
+// Returns the submatch indices of the last match which starts before 'before'
+// and passes 'accept'. Matching starts at the beginning of a line not far
+// before 'before', the window grows until a match is found or it covers the
+// whole text.
+func regexp_search_backward(data []byte, re *regexp.Regexp, before int, accept func([]int) bool) ([]int, bool) {
+	for size := 4096; ; size *= 2 {
+		start := 0
+		if before > size {
+			start = bytes.LastIndexByte(data[:before-size], '\n') + 1
+		}
+		var last []int
+		for n := 16; ; n *= 2 {
+			last = nil
+			matches := re.FindAllSubmatchIndex(data[start:], n)
+			done := len(matches) < n
+			for _, m := range matches {
+				if start+m[0] >= before {
+					done = true
+					break
+				}
+				m = shift_match(m, start)
+				if accept == nil || accept(m) {
+					last = m
+				}
+			}
+			if done {
+				break
+			}
+		}
+		if last != nil || start == 0 {
+			return last, last != nil
+		}
+	}
+}
+
+func shift_match(m []int, n int) []int {
+	for i := range m {
+		if m[i] >= 0 {
+			m[i] += n
+		}
+	}
+	return m
+}
+
+// Finds the matches of 'highlight_regexp' on the visible lines, the ranges are
+// stored per line for 'draw_line'. Matches starting above the view are not
+// highlighted, neither are the ones which are not whole words when
+// 'highlight_words' is set.
+func (v *view) find_regexp_ranges() {
+	v.regexp_ranges = v.regexp_ranges[:0]
+	var data []byte
+	var starts []int
+	line := v.top_line
+	for y, h := 0, v.height(); y < h && line != nil; y++ {
+		if y > 0 {
+			data = append(data, '\n')
+		}
+		starts = append(starts, len(data))
+		data = append(data, line.data...)
+		v.regexp_ranges = append(v.regexp_ranges, nil)
+		line = line.next
+	}
+
+	y := 0
+	for _, m := range v.highlight_regexp.FindAllIndex(data, -1) {
+		if m[0] == m[1] || v.highlight_words && !is_whole_word_match(data, m[0], m[1]) {
+			continue
+		}
+		for y+1 < len(starts) && starts[y+1] <= m[0] {
+			y++
+		}
+		// split the match into the parts on each line
+		for i := y; i < len(starts) && starts[i] < m[1]; i++ {
+			end := len(data)
+			if i+1 < len(starts) {
+				end = starts[i+1] - 1
+			}
+			r := byte_range{begin: 0, end: end - starts[i]}
+			if m[0] > starts[i] {
+				r.begin = m[0] - starts[i]
+			}
+			if m[1] < end {
+				r.end = m[1] - starts[i]
+			}
+			v.regexp_ranges[i] = append(v.regexp_ranges[i], r)
+		}
+	}
+}
+
+func (v *view) regexp_ranges_for(line_num int) []byte_range {
+	y := line_num - v.top_line_num
+	if y < 0 || y >= len(v.regexp_ranges) {
+		return nil
+	}
+	return v.regexp_ranges[y]
+}
@@ -0,0 +1,82 @@
+package main
+
+import "strings"
+import "testing"
+
+func TestRegexpSearch(t *testing.T) {
+	buf, _ := new_buffer(strings.NewReader("func aHandler() {\r\n}\r\nfunc b() {}\r\nfunc cHandler"))
+	data := buf.joined_lines()
+	if string(data) != "func aHandler() {\n}\nfunc b() {}\nfunc cHandler" {
+		t.Fatalf("unexpected text %q", data)
+	}
+	re, err := compile_search_regexp(`func \w+Handler`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, ok := regexp_search_forward(data, re, 1, nil)
+	if !ok || string(data[m[0]:m[1]]) != "func cHandler" {
+		t.Errorf("forward search found %v", m)
+	}
+	m, ok = regexp_search_backward(data, re, m[0], nil)
+	if !ok || m[0] != 0 {
+		t.Errorf("backward search found %v", m)
+	}
+	if _, ok := regexp_search_backward(data, re, 0, nil); ok {
+		t.Errorf("found a match before the beginning")
+	}
+
+	// '^' sees the beginning of the line even when searching from its middle
+	re, _ = compile_search_regexp(`^func`)
+	if m, ok := regexp_search_forward(data, re, 2, nil); !ok || m[0] != 20 {
+		t.Errorf("anchored search found %v", m)
+	}
+
+	// matches spanning lines
+	re, _ = compile_search_regexp(`\{\n\}`)
+	m, ok = regexp_search_forward(data, re, 0, nil)
+	if !ok {
+		t.Fatal("multi-line match not found")
+	}
+	beg, end := buf.offset_to_cursor(m[0]), buf.offset_to_cursor(m[1])
+	if beg.line_num != 1 || beg.boffset != 16 || end.line_num != 2 || end.boffset != 1 {
+		t.Errorf("match from %d:%d to %d:%d", beg.line_num, beg.boffset, end.line_num, end.boffset)
+	}
+
+	// backward search looks further back until it finds something
+	long := []byte("needle\n" + strings.Repeat("hay\n", 5000) + "needle")
+	re, _ = compile_search_regexp(`needle`)
+	if m, ok := regexp_search_backward(long, re, len(long)-6, nil); !ok || m[0] != 0 {
+		t.Errorf("backward search far away found %v", m)
+	}
+	if m, ok := regexp_search_backward(long, re, len(long), nil); !ok || m[0] != len(long)-6 {
+		t.Errorf("backward search nearby found %v", m)
+	}
+}
+
+func TestRegexpHighlight(t *testing.T) {
+	v := new_test_view("ab\ncd\nxab\n")
+	v.resize(20, 5)
+	v.highlight_regexp, _ = compile_search_regexp(`b\nc|ab`)
+	v.find_regexp_ranges()
+	want := [][]byte_range{
+		{{0, 2}}, // "ab" is found first
+		nil,
+		{{1, 3}},
+	}
+	for i, w := range want {
+		got := v.regexp_ranges_for(i + 1)
+		if len(got) != len(w) || (len(w) > 0 && got[0] != w[0]) {
+			t.Errorf("line %d: got %v, want %v", i+1, got, w)
+		}
+	}
+
+	v.highlight_regexp, _ = compile_search_regexp(`b\nc`)
+	v.find_regexp_ranges()
+	if got := v.regexp_ranges_for(1); len(got) != 1 || got[0] != (byte_range{1, 2}) {
+		t.Errorf("first line of a multi-line match: %v", got)
+	}
+	if got := v.regexp_ranges_for(2); len(got) != 1 || got[0] != (byte_range{0, 1}) {
+		t.Errorf("second line of a multi-line match: %v", got)
+	}
+}
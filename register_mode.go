@@ -0,0 +1,177 @@
+package main
+
+import (
+	"github.com/nsf/termbox-go"
+	"github.com/nsf/tulib"
+)
+
+//----------------------------------------------------------------------------
+// registers
+//
+// A register is named by a character and holds either text or a position in
+// a buffer. Positions follow the edits like the mark does and are dropped
+// along with their buffer.
+//----------------------------------------------------------------------------
+
+type register struct {
+	text []byte
+
+	// position registers have 'buf' set
+	buf *buffer
+	loc cursor_location
+}
+
+type registers map[rune]*register
+
+func (r registers) adjust(buf *buffer, a *action, what action_type) {
+	for _, reg := range r {
+		if reg.buf == buf {
+			adjust_location(&reg.loc, a, what)
+		}
+	}
+}
+
+func (r registers) remove_buffer(buf *buffer) {
+	for name, reg := range r {
+		if reg.buf == buf {
+			delete(r, name)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------
+// register mode
+//
+// Commands behind the C-x r prefix, the first key picks the command, the
+// second one names the register. Rectangle commands (see rectangle.go) are
+// run right away.
+//----------------------------------------------------------------------------
+
+type register_mode struct {
+	stub_overlay_mode
+	godit *godit
+	cmd   rune
+}
+
+var register_mode_prompts = map[rune]string{
+	's': "Copy region to register:",
+	'i': "Insert register:",
+	' ': "Point to register:",
+	'j': "Jump to register:",
+}
+
+func init_register_mode(godit *godit) *register_mode {
+	m := new(register_mode)
+	m.godit = godit
+	m.godit.set_status("C-x r-")
+	return m
+}
+
+func (m *register_mode) on_key(ev *termbox.Event) {
+	g := m.godit
+	if m.cmd == 0 {
+		if fn := m.rectangle_command(ev); fn != nil {
+			g.set_overlay_mode(nil)
+			fn()
+			return
+		}
+		ch := ev.Ch
+		if ev.Key == termbox.KeySpace {
+			ch = ' '
+		}
+		if _, ok := register_mode_prompts[ch]; !ok || ev.Mod != 0 {
+			g.set_overlay_mode(nil)
+			g.set_status("C-x r %s is undefined", tulib.KeyToString(ev.Key, ev.Ch, ev.Mod))
+			return
+		}
+		m.cmd = ch
+		g.set_status("%s", register_mode_prompts[ch])
+		return
+	}
+
+	name := ev.Ch
+	if ev.Key == termbox.KeySpace {
+		name = ' '
+	}
+	g.set_overlay_mode(nil)
+	if name == 0 || ev.Mod != 0 {
+		g.set_status("Register names are characters")
+		return
+	}
+	m.run(name)
+}
+
+func (m *register_mode) rectangle_command(ev *termbox.Event) func() {
+	g := m.godit
+	if ev.Mod == termbox.ModAlt && ev.Ch == 'w' {
+		return g.copy_rectangle
+	}
+	if ev.Mod != 0 {
+		return nil
+	}
+	switch ev.Ch {
+	case 'k':
+		return g.kill_rectangle
+	case 'y':
+		return g.yank_rectangle
+	case 'd':
+		return func() {
+			g.edit_rectangle((*view).delete_rectangle)
+		}
+	case 'o':
+		return func() {
+			g.edit_rectangle((*view).open_rectangle)
+		}
+	case 'N':
+		return func() {
+			g.edit_rectangle((*view).number_rectangle)
+		}
+	case 't':
+		return func() {
+			g.set_overlay_mode(init_line_edit_mode(g, g.string_rectangle_lemp()))
+		}
+	}
+	return nil
+}
+
+func (m *register_mode) run(name rune) {
+	g := m.godit
+	v := g.active.leaf
+	reg := g.registers[name]
+	switch m.cmd {
+	case 's':
+		if !v.buf.is_mark_set() {
+			g.set_status("The mark is not set now, so there is no region")
+			return
+		}
+		c1, c2 := v.cursor, v.buf.mark
+		d := c1.distance(c2)
+		if d < 0 {
+			c1, d = c2, -d
+		}
+		g.registers[name] = &register{text: c1.extract_bytes(d)}
+		g.set_status("Copied region to register %c", name)
+	case 'i':
+		if reg == nil || reg.buf != nil {
+			g.set_status("Register %c doesn't contain text", name)
+			return
+		}
+		if v.buf.readonly {
+			g.set_status("%s", err_readonly_buffer)
+			return
+		}
+		v.finalize_action_group()
+		v.insert_yanked(reg.text)
+		v.finalize_action_group()
+	case ' ':
+		g.registers[name] = &register{buf: v.buf, loc: v.cursor}
+		g.set_status("Saved position to register %c", name)
+	case 'j':
+		if reg == nil || reg.buf == nil {
+			g.set_status("Register %c doesn't contain a position", name)
+			return
+		}
+		v.push_jump()
+		g.jump_to(jump{reg.buf, reg.loc})
+	}
+}
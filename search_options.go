@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/nsf/termbox-go"
+)
+
+//----------------------------------------------------------------------------
+// search options
+//
+// Searches ignore case unless the pattern has upper case letters in it
+// (smart-case), M-c in a search prompt forces the opposite of what is in
+// effect. M-w makes only whole words match. Searches which ignore case or
+// look for whole words go through regexps, literal patterns are quoted.
+// Words are checked with 'is_word' around each match, '\b' in Go regexps
+// knows only ASCII.
+//----------------------------------------------------------------------------
+
+type case_mode int
+
+const (
+	case_smart case_mode = iota
+	case_fold
+	case_sensitive
+)
+
+type search_options struct {
+	case_mode  case_mode
+	whole_word bool
+}
+
+// Whether the pattern has upper case letters, escaped characters in regexps
+// (like '\W') don't count.
+func has_upper(pattern []byte, is_regexp bool) bool {
+	for len(pattern) > 0 {
+		r, rlen := utf8.DecodeRune(pattern)
+		pattern = pattern[rlen:]
+		if r == '\\' && is_regexp && len(pattern) > 0 {
+			_, rlen = utf8.DecodeRune(pattern)
+			pattern = pattern[rlen:]
+			continue
+		}
+		if unicode.IsUpper(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o search_options) folds(pattern []byte, is_regexp bool) bool {
+	switch o.case_mode {
+	case case_fold:
+		return true
+	case case_sensitive:
+		return false
+	}
+	return !has_upper(pattern, is_regexp)
+}
+
+// Whether a literal pattern can be searched for byte by byte.
+func (o search_options) plain(pattern []byte) bool {
+	return !o.whole_word && !o.folds(pattern, false)
+}
+
+func (o *search_options) toggle_case(pattern []byte, is_regexp bool) {
+	if o.folds(pattern, is_regexp) {
+		o.case_mode = case_sensitive
+	} else {
+		o.case_mode = case_fold
+	}
+}
+
+// Handles M-c and M-w, returns false for other keys.
+func (o *search_options) on_key(ev *termbox.Event, pattern []byte, is_regexp bool) bool {
+	if ev.Mod != termbox.ModAlt {
+		return false
+	}
+	switch ev.Ch {
+	case 'c':
+		o.toggle_case(pattern, is_regexp)
+	case 'w':
+		o.whole_word = !o.whole_word
+	default:
+		return false
+	}
+	return true
+}
+
+// Describes the options in effect for a prompt, like "case-sensitive word ".
+func (o search_options) describe(pattern []byte, is_regexp bool) string {
+	var s string
+	if !o.folds(pattern, is_regexp) {
+		s += "case-sensitive "
+	}
+	if o.whole_word {
+		s += "word "
+	}
+	return s
+}
+
+// Puts the description of the options in front of the prompt.
+func (o search_options) prompt(prompt string, pattern []byte, is_regexp bool) string {
+	d := o.describe(pattern, is_regexp)
+	if d == "" {
+		return prompt
+	}
+	return upper_first(d + lower_first(prompt))
+}
+
+func upper_first(s string) string {
+	if s == "" {
+		return s
+	}
+	r, rlen := utf8.DecodeRuneInString(s)
+	return string(unicode.ToUpper(r)) + s[rlen:]
+}
+
+func lower_first(s string) string {
+	if s == "" {
+		return s
+	}
+	r, rlen := utf8.DecodeRuneInString(s)
+	return string(unicode.ToLower(r)) + s[rlen:]
+}
+
+func (o search_options) compile(pattern []byte, is_regexp bool) (*regexp.Regexp, error) {
+	s := string(pattern)
+	if !is_regexp {
+		s = regexp.QuoteMeta(s)
+	}
+	if o.folds(pattern, is_regexp) {
+		s = "(?i)" + s
+	}
+	return compile_search_regexp(s)
+}
+
+// Returns the check for the matches found in 'data', nil if any match will do.
+func (o search_options) accept(data []byte) func(m []int) bool {
+	if !o.whole_word {
+		return nil
+	}
+	return func(m []int) bool {
+		return is_whole_word_match(data, m[0], m[1])
+	}
+}
+
+func is_whole_word_match(data []byte, beg, end int) bool {
+	if beg == end {
+		return false
+	}
+	if r, rlen := decode_last_rune(data[:beg]); rlen != 0 && is_word(r) {
+		return false
+	}
+	if r, rlen := decode_rune(data[end:]); rlen != 0 && is_word(r) {
+		return false
+	}
+	return true
+}
+
+// Adapts the replacement to the case of the text it replaces: "FOO" makes it
+// upper case and "Foo" capitalizes it. Replacements with upper case letters
+// are used as they are.
+func preserve_case(match, repl []byte) []byte {
+	if has_upper(repl, false) {
+		return repl
+	}
+	upper, lower := 0, 0
+	first_upper := false
+	for _, r := range string(match) {
+		switch {
+		case unicode.IsUpper(r):
+			if upper+lower == 0 {
+				first_upper = true
+			}
+			upper++
+		case unicode.IsLower(r):
+			lower++
+		}
+	}
+	switch {
+	case upper > 1 && lower == 0:
+		return bytes.ToUpper(repl)
+	case first_upper:
+		return []byte(upper_first(string(repl)))
+	}
+	return repl
+}
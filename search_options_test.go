@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestSearchOptionsFolds(t *testing.T) {
+	var o search_options
+	if !o.folds([]byte("foo"), false) || o.folds([]byte("Foo"), false) {
+		t.Error("smart-case should depend on upper case letters")
+	}
+	if !o.folds([]byte(`\Wfoo`), true) {
+		t.Error("escaped characters in regexps are not upper case letters")
+	}
+	o.toggle_case([]byte("foo"), false)
+	if o.folds([]byte("foo"), false) {
+		t.Error("M-c should make the search case-sensitive")
+	}
+	if got := o.prompt("Replace string:", nil, false); got != "Case-sensitive replace string:" {
+		t.Errorf("got prompt %q", got)
+	}
+}
+
+func TestPreserveCase(t *testing.T) {
+	tests := []struct{ match, repl, want string }{
+		{"foo", "bar", "bar"},
+		{"Foo", "bar", "Bar"},
+		{"FOO", "bar", "BAR"},
+		{"FOO", "baR", "baR"},
+		{"Foo", "", ""},
+	}
+	for _, tt := range tests {
+		if got := string(preserve_case([]byte(tt.match), []byte(tt.repl))); got != tt.want {
+			t.Errorf("preserve_case(%q, %q) = %q, want %q", tt.match, tt.repl, got, tt.want)
+		}
+	}
+}
+
+func TestSearchAndReplaceOptions(t *testing.T) {
+	replace := func(text, word, repl string, opts search_options) string {
+		v := new_test_view(text)
+		v.buf.mark = v.cursor
+		v.move_cursor_to(cursor_location{v.buf.last_line, v.buf.lines_n, len(v.buf.last_line.data)})
+		v.search_and_replace([]byte(word), []byte(repl), opts)
+		return string(v.buf.contents())
+	}
+
+	got := replace("foo Foo FOO food", "foo", "bar", search_options{})
+	if want := "bar Bar BAR bard"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	got = replace("foo Foo FOO food", "foo", "bar", search_options{whole_word: true})
+	if want := "bar Bar BAR food"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	got = replace("foo Foo FOO food", "Foo", "bar", search_options{})
+	if want := "foo bar FOO food"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
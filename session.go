@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+//----------------------------------------------------------------------------
+// session
+//
+// A session is the set of buffers visiting files along with their locations
+// and marks, and the layout of the views with their split ratios. It's kept in
+// a JSON file, buffers are referred to by their paths. Files may change
+// between saving and restoring a session, so locations are clamped to what's
+// in the buffer instead of being rejected.
+//----------------------------------------------------------------------------
+
+const session_version = 1
+
+type session struct {
+	Version int
+	Buffers []session_buffer
+	Layout  *session_view
+}
+
+type session_buffer struct {
+	Path     string
+	Name     string
+	Location session_location
+	Mark     *session_cursor `json:",omitempty"`
+}
+
+// A node of the view tree: either a split ("horizontal" for left/right,
+// "vertical" for top/bottom) with two children, or a view of a buffer.
+type session_view struct {
+	Split  string        `json:",omitempty"`
+	Ratio  float32       `json:",omitempty"`
+	First  *session_view `json:",omitempty"`
+	Second *session_view `json:",omitempty"`
+
+	Buffer   int
+	Location session_location
+	Active   bool `json:",omitempty"`
+}
+
+type session_location struct {
+	Cursor     session_cursor
+	TopLine    int
+	LineOffset int
+}
+
+type session_cursor struct {
+	Line   int
+	Offset int
+}
+
+func make_session_location(loc *view_location) session_location {
+	return session_location{
+		Cursor:     session_cursor{loc.cursor.line_num, loc.cursor.boffset},
+		TopLine:    loc.top_line_num,
+		LineOffset: loc.line_voffset,
+	}
+}
+
+// Returns the location in the buffer closest to line 'line_num', byte offset
+// 'boffset'.
+func (b *buffer) location_at(line_num, boffset int) cursor_location {
+	if line_num > b.lines_n {
+		line_num = b.lines_n
+	}
+	c := cursor_location{b.first_line, 1, 0}
+	for c.line_num < line_num {
+		c.line = c.line.next
+		c.line_num++
+	}
+	if boffset > len(c.line.data) {
+		boffset = len(c.line.data)
+	}
+	if boffset > 0 {
+		// don't end up in the middle of a character
+		for boffset > 0 && !rune_start(c.line.data, boffset) {
+			boffset--
+		}
+		c.boffset = boffset
+	}
+	return c
+}
+
+func rune_start(data []byte, offset int) bool {
+	return offset >= len(data) || data[offset]&0xC0 != 0x80
+}
+
+func (b *buffer) make_view_location(l session_location) view_location {
+	c := b.location_at(l.Cursor.Line, l.Cursor.Offset)
+	top := b.location_at(l.TopLine, 0)
+	if top.line_num > c.line_num {
+		top = cursor_location{c.line, c.line_num, 0}
+	}
+	vo, co := c.voffset_coffset()
+	return view_location{
+		cursor:              c,
+		top_line:            top.line,
+		top_line_num:        top.line_num,
+		cursor_coffset:      co,
+		cursor_voffset:      vo,
+		line_voffset:        l.LineOffset,
+		last_cursor_voffset: vo,
+	}
+}
+
+func (g *godit) make_session() *session {
+	s := &session{Version: session_version}
+	index := make(map[*buffer]int)
+	for _, buf := range g.buffers {
+		if buf.path == "" {
+			continue
+		}
+		sb := session_buffer{
+			Path:     buf.path,
+			Name:     buf.name,
+			Location: make_session_location(&buf.loc),
+		}
+		if buf.is_mark_set() {
+			sb.Mark = &session_cursor{buf.mark.line_num, buf.mark.boffset}
+		}
+		index[buf] = len(s.Buffers)
+		s.Buffers = append(s.Buffers, sb)
+	}
+
+	var make_view func(t *view_tree) *session_view
+	make_view = func(t *view_tree) *session_view {
+		switch {
+		case t.left != nil:
+			return &session_view{
+				Split:  "horizontal",
+				Ratio:  t.split,
+				First:  make_view(t.left),
+				Second: make_view(t.right),
+			}
+		case t.top != nil:
+			return &session_view{
+				Split:  "vertical",
+				Ratio:  t.split,
+				First:  make_view(t.top),
+				Second: make_view(t.bottom),
+			}
+		}
+		sv := &session_view{Buffer: -1, Active: t == g.active}
+		if i, ok := index[t.leaf.buf]; ok {
+			sv.Buffer = i
+			sv.Location = make_session_location(&t.leaf.view_location)
+		}
+		return sv
+	}
+	s.Layout = make_view(g.views)
+	return s
+}
+
+func (g *godit) save_session(filename string) error {
+	data, err := json.MarshalIndent(g.make_session(), "", "\t")
+	if err != nil {
+		return err
+	}
+	return atomic_write_file(filename, append(data, '\n'))
+}
+
+func read_session(filename string) (*session, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	s := new(session)
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	if s.Version != session_version || s.Layout == nil {
+		return nil, fmt.Errorf("%s: not a session file", filename)
+	}
+	return s, nil
+}
+
+// Opens the buffers of the session and replaces the views with its layout.
+// Buffers which are already open stay as they are, only their locations are
+// restored.
+func (g *godit) restore_session(filename string) error {
+	s, err := read_session(filename)
+	if err != nil {
+		return err
+	}
+
+	buffers := make([]*buffer, len(s.Buffers))
+	for i, sb := range s.Buffers {
+		buf := g.find_buffer_by_full_path(sb.Path)
+		if buf == nil {
+			buf, err = g.new_buffer_from_file(sb.Path)
+			if err != nil {
+				continue
+			}
+			if sb.Name != "" {
+				buf.name = ""
+				buf.name = g.buffer_name(sb.Name)
+			}
+		}
+		buf.loc = buf.make_view_location(sb.Location)
+		if sb.Mark != nil {
+			buf.mark = buf.location_at(sb.Mark.Line, sb.Mark.Offset)
+		}
+		buffers[i] = buf
+	}
+
+	var active *view_tree
+	var created []*view
+	var make_tree func(parent *view_tree, sv *session_view) (*view_tree, error)
+	make_tree = func(parent *view_tree, sv *session_view) (*view_tree, error) {
+		t := &view_tree{parent: parent, split: sv.Ratio}
+		if sv.Split != "" {
+			if sv.First == nil || sv.Second == nil {
+				return nil, errors.New("split without two views")
+			}
+			first, err := make_tree(t, sv.First)
+			if err != nil {
+				return nil, err
+			}
+			second, err := make_tree(t, sv.Second)
+			if err != nil {
+				return nil, err
+			}
+			switch sv.Split {
+			case "horizontal":
+				t.left, t.right = first, second
+			case "vertical":
+				t.top, t.bottom = first, second
+			default:
+				return nil, fmt.Errorf("unknown split %q", sv.Split)
+			}
+			return t, nil
+		}
+
+		var buf *buffer
+		if sv.Buffer >= 0 && sv.Buffer < len(buffers) {
+			buf = buffers[sv.Buffer]
+		}
+		if buf == nil {
+			// the file is gone, show the first buffer there is
+			t.leaf = new_view(g.view_context(), g.buffers[0])
+		} else {
+			t.leaf = new_view(g.view_context(), buf)
+			t.leaf.view_location = buf.make_view_location(sv.Location)
+		}
+		created = append(created, t.leaf)
+		if sv.Active || active == nil {
+			active = t
+		}
+		return t, nil
+	}
+	views, err := make_tree(nil, s.Layout)
+	if err != nil {
+		// the current views are not touched yet, drop the new ones
+		for _, v := range created {
+			v.detach()
+		}
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+
+	g.views.traverse(func(t *view_tree) {
+		t.leaf.deactivate()
+		t.leaf.detach()
+	})
+	g.views = views
+	g.active = active
+	g.active.leaf.activate()
+	g.resize()
+	return nil
+}
+
+func (g *godit) save_session_lemp() line_edit_mode_params {
+	return line_edit_mode_params{
+		ac_decide:       filesystem_line_ac_decide,
+		prompt:          "Save session to:",
+		initial_content: default_session_file(),
+		on_apply: func(buf *buffer) {
+			filename := abs_path(string(buf.contents()))
+			if err := g.save_session(filename); err != nil {
+				g.set_status("%s", err)
+				return
+			}
+			g.set_status("Session saved to %s", filename)
+		},
+	}
+}
+
+func (g *godit) restore_session_lemp() line_edit_mode_params {
+	return line_edit_mode_params{
+		ac_decide:       filesystem_line_ac_decide,
+		prompt:          "Restore session from:",
+		initial_content: default_session_file(),
+		on_apply: func(buf *buffer) {
+			filename := abs_path(string(buf.contents()))
+			if err := g.restore_session(filename); err != nil {
+				g.set_status("%s", err)
+				return
+			}
+			g.set_status("Session restored from %s", filename)
+		},
+	}
+}
+
+func default_session_file() string {
+	if *session_file != "" {
+		return *session_file
+	}
+	return substitute_home("~/.tam-session")
+}
+
+// Restores the session given with '-session' at startup, if the file exists.
+func (g *godit) restore_startup_session() {
+	if *session_file == "" {
+		return
+	}
+	if _, err := os.Stat(*session_file); err != nil {
+		return
+	}
+	if err := g.restore_session(*session_file); err != nil {
+		g.set_status("%s", err)
+	}
+}
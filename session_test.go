@@ -0,0 +1,59 @@
+package main
+
+import "io/ioutil"
+import "path/filepath"
+import "testing"
+
+func TestSession(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	dir := t.TempDir()
+
+	a := filepath.Join(dir, "a.txt")
+	b := filepath.Join(dir, "b.txt")
+	ioutil.WriteFile(a, []byte("one\ntwo\nthree\nfour\n"), 0644)
+	ioutil.WriteFile(b, []byte("héllo\nworld\n"), 0644)
+
+	g := new_godit([]string{a, b})
+	g.views.split_horizontally()
+	g.views.split = 0.3
+	g.views.right.split_vertically()
+	g.active = g.views.right.bottom
+	g.active.leaf.attach(g.buffers[1])
+	g.active.leaf.move_cursor_to(g.buffers[1].location_at(1, 3))
+	g.views.left.leaf.move_cursor_to(g.buffers[0].location_at(3, 2))
+	g.buffers[0].mark = g.buffers[0].location_at(2, 1)
+
+	session := filepath.Join(dir, "session")
+	if err := g.save_session(session); err != nil {
+		t.Fatal(err)
+	}
+
+	g = new_godit(nil)
+	if err := g.restore_session(session); err != nil {
+		t.Fatal(err)
+	}
+	if g.views.left == nil || g.views.split != 0.3 || g.views.right.top == nil {
+		t.Fatal("layout is not restored")
+	}
+	left := g.views.left.leaf
+	if left.buf.path != a || left.cursor.line_num != 3 || left.cursor.boffset != 2 {
+		t.Fatalf("left view: %s at %d:%d", left.buf.path, left.cursor.line_num, left.cursor.boffset)
+	}
+	if g.active != g.views.right.bottom || g.active.leaf.buf.path != b {
+		t.Fatal("active view is not restored")
+	}
+	if c := g.active.leaf.cursor; c.line_num != 1 || c.boffset != 3 {
+		t.Fatalf("active view cursor at %d:%d", c.line_num, c.boffset)
+	}
+	if m := left.buf.mark; m.line_num != 2 || m.boffset != 1 {
+		t.Fatalf("mark at %d:%d", m.line_num, m.boffset)
+	}
+
+	// locations out of the buffer are clamped, never inside a character
+	if c := g.active.leaf.buf.location_at(1, 2); c.boffset != 1 {
+		t.Fatalf("location inside 'é' at offset %d", c.boffset)
+	}
+	if c := g.active.leaf.buf.location_at(10, 10); c.line_num != 3 || c.boffset != 0 {
+		t.Fatalf("location past the end at %d:%d", c.line_num, c.boffset)
+	}
+}
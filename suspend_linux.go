@@ -7,6 +7,7 @@ import (
 
 func suspend(g *godit) {
 	// finalize termbox
+	set_bracketed_paste(false)
 	termbox.Close()
 
 	// suspend the process
@@ -22,6 +23,7 @@ func suspend(g *godit) {
 	if err != nil {
 		panic(err)
 	}
-	termbox.SetInputMode(termbox.InputAlt)
+	termbox.SetInputMode(termbox.InputAlt | termbox.InputMouse)
+	set_bracketed_paste(true)
 	g.resize()
 }
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//----------------------------------------------------------------------------
+// undo file
+//
+// The undo history of a buffer is written to the cache directory on every
+// save and loaded back when the file is opened again. Only the branch leading
+// to the saved state is kept. Lines are referred to by their numbers, which
+// are turned back into actual lines by reverting the history on the loaded
+// buffer and applying it again. The file also keeps a hash of the contents it
+// applies to, if the file was changed outside of the editor, the history is
+// simply dropped.
+//----------------------------------------------------------------------------
+
+const (
+	undo_file_magic    = "tam-undo 1\n"
+	undo_file_max_size = 4 << 20
+)
+
+var err_bad_undo_file = errors.New("undo history doesn't match the buffer")
+
+type undo_file struct {
+	Path   string
+	Hash   []byte
+	Groups []undo_file_group
+}
+
+type undo_file_group struct {
+	Actions []undo_file_action
+	Before  undo_file_cursor
+	After   undo_file_cursor
+	Time    time.Time
+}
+
+type undo_file_action struct {
+	Insert bool
+	Data   []byte
+	Cursor undo_file_cursor
+}
+
+type undo_file_cursor struct {
+	Line   int
+	Offset int
+}
+
+func make_undo_file_cursor(c cursor_location) undo_file_cursor {
+	return undo_file_cursor{c.line_num, c.boffset}
+}
+
+func undo_file_path(path string) string {
+	sum := sha1.Sum([]byte(path))
+	return filepath.Join(cache_dir("undo"), hex.EncodeToString(sum[:]))
+}
+
+func contents_hash(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// Writes the history leading to the current state of the buffer, 'data' is
+// what was written to 'filename'. The oldest groups are left out if the
+// history doesn't fit into 'undo_file_max_size'.
+func (b *buffer) save_undo_history(filename string, data []byte) error {
+	var groups []undo_file_group
+	size := 0
+	for ag := b.history; ag.prev != nil; ag = ag.prev {
+		fg := undo_file_group{
+			Actions: make([]undo_file_action, len(ag.actions)),
+			Before:  make_undo_file_cursor(ag.before),
+			After:   make_undo_file_cursor(ag.after),
+			Time:    ag.time,
+		}
+		for i := range ag.actions {
+			a := &ag.actions[i]
+			fg.Actions[i] = undo_file_action{
+				Insert: a.what == action_insert,
+				Data:   a.data,
+				Cursor: make_undo_file_cursor(a.cursor),
+			}
+			size += len(a.data)
+		}
+		if size > undo_file_max_size {
+			break
+		}
+		groups = append(groups, fg)
+	}
+
+	name := undo_file_path(filename)
+	if len(groups) == 0 {
+		os.Remove(name)
+		return nil
+	}
+
+	// oldest group goes first
+	for i, j := 0, len(groups)-1; i < j; i, j = i+1, j-1 {
+		groups[i], groups[j] = groups[j], groups[i]
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(undo_file_magic)
+	err := gob.NewEncoder(&buf).Encode(&undo_file{
+		Path:   filename,
+		Hash:   contents_hash(data),
+		Groups: groups,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(cache_dir("undo"), 0700); err != nil {
+		return err
+	}
+	return atomic_write_file(name, buf.Bytes())
+}
+
+// Reads the history saved for 'path', 'hash' is the hash of the file contents
+// the buffer was loaded from. Stale or broken history files are removed.
+func read_undo_file(path string, hash []byte) (*undo_file, error) {
+	name := undo_file_path(path)
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var uf undo_file
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(undo_file_magic))
+	_, err = io.ReadFull(r, magic)
+	if err == nil && string(magic) != undo_file_magic {
+		err = errors.New("unknown undo file format")
+	}
+	if err == nil {
+		err = gob.NewDecoder(r).Decode(&uf)
+	}
+	if err == nil && (uf.Path != path || !bytes.Equal(uf.Hash, hash)) {
+		err = errors.New("file was changed outside of the editor")
+	}
+	if err != nil {
+		os.Remove(name)
+		return nil, err
+	}
+	return &uf, nil
+}
+
+// Resolves a serialized cursor against the current state of the buffer.
+func (b *buffer) undo_file_cursor(c undo_file_cursor) (cursor_location, bool) {
+	if c.Line < 1 || c.Line > b.lines_n {
+		return cursor_location{}, false
+	}
+	l := b.first_line
+	for i := 1; i < c.Line; i++ {
+		l = l.next
+	}
+	if c.Offset < 0 || c.Offset > len(l.data) {
+		return cursor_location{}, false
+	}
+	return cursor_location{l, c.Line, c.Offset}, true
+}
+
+// Resolves a serialized action against the current state of the buffer, the
+// buffer must be in the state right after the action was applied.
+func (b *buffer) undo_file_action(fa *undo_file_action) (action, bool) {
+	c, ok := b.undo_file_cursor(fa.Cursor)
+	if !ok {
+		return action{}, false
+	}
+	a := action{
+		what:   action_delete,
+		data:   fa.Data,
+		cursor: c,
+		lines:  make([]*line, bytes.Count(fa.Data, []byte{'\n'})),
+	}
+	if !fa.Insert {
+		for i := range a.lines {
+			a.lines[i] = new(line)
+		}
+		return a, true
+	}
+
+	a.what = action_insert
+	if c.distance(cursor_location{b.last_line, b.lines_n, len(b.last_line.data)}) < len(a.data) ||
+		!bytes.Equal(c.extract_bytes(len(a.data)), a.data) {
+		return action{}, false
+	}
+	for i := range a.lines {
+		a.lines[i] = c.line.next
+		c.line = c.line.next
+	}
+	return a, true
+}
+
+// Rebuilds the buffer history from an undo file. The buffer must be in the
+// state the history leads to, which is guaranteed by the contents hash.
+func (v *view) restore_undo_history(uf *undo_file) error {
+	b := v.buf
+	groups := make([]*action_group, len(uf.Groups))
+	var reverted []*action
+
+	// revert everything, resolving the lines on the way
+	var err error
+revert:
+	for i := len(uf.Groups) - 1; i >= 0; i-- {
+		fg := &uf.Groups[i]
+		ag := new(action_group)
+		ag.actions = make([]action, len(fg.Actions))
+		ag.time = fg.Time
+		after, ok := b.undo_file_cursor(fg.After)
+		if !ok || len(fg.Actions) == 0 {
+			err = err_bad_undo_file
+			break
+		}
+		ag.after = after
+		for j := len(fg.Actions) - 1; j >= 0; j-- {
+			a, ok := b.undo_file_action(&fg.Actions[j])
+			if !ok {
+				err = err_bad_undo_file
+				break revert
+			}
+			ag.actions[j] = a
+			ag.actions[j].revert(v)
+			reverted = append(reverted, &ag.actions[j])
+		}
+		ag.before, ok = b.undo_file_cursor(fg.Before)
+		if !ok {
+			err = err_bad_undo_file
+			break
+		}
+		groups[i] = ag
+	}
+	if err != nil {
+		// put the buffer back into its original state
+		for i := len(reverted) - 1; i >= 0; i-- {
+			reverted[i].apply(v)
+		}
+		return err
+	}
+
+	// and apply it back, building the history
+	b.init_history()
+	for _, ag := range groups {
+		for i := range ag.actions {
+			ag.actions[i].apply(v)
+		}
+		ag.prev = b.history
+		b.history.next = ag
+		b.history.children = append(b.history.children, ag)
+		b.history = ag
+		b.history_size += ag.memory_cost()
+	}
+	b.history.next = new(action_group)
+	b.on_disk = b.history
+	return nil
+}
+
+// Loads the undo history of a freshly opened buffer if there is one, 'hash'
+// is the hash of the file contents.
+func (g *godit) load_undo_history(buf *buffer, hash []byte) {
+	uf, err := read_undo_file(buf.path, hash)
+	if err != nil {
+		return
+	}
+	g.with_view(buf, func(v *view) {
+		err = v.restore_undo_history(uf)
+	})
+	if err != nil {
+		os.Remove(undo_file_path(buf.path))
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+
+func TestUndoFile(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", dir)
+	path := filepath.Join(dir, "file.txt")
+
+	original := "first\nsecond\nthird\n"
+	v := new_test_view(original)
+	c := cursor_location{v.buf.first_line, 1, 5}
+	v.action_insert(c, []byte(" line\nand a half"))
+	v.finalize_action_group()
+	c = cursor_location{v.buf.first_line.next.next, 3, 0}
+	v.action_delete(c, 7)
+	v.finalize_action_group()
+	c = cursor_location{v.buf.last_line, v.buf.lines_n, 0}
+	v.action_insert(c, []byte("fourth\n\n"))
+	v.finalize_action_group()
+
+	edited := string(v.buf.contents())
+	if err := v.buf.save_undo_history(path, v.buf.contents()); err != nil {
+		t.Fatal(err)
+	}
+
+	// load it back on a fresh buffer and undo everything
+	v = new_test_view(edited)
+	uf, err := read_undo_file(path, contents_hash([]byte(edited)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.restore_undo_history(uf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(v.buf.contents()); got != edited {
+		t.Fatalf("restoring history changed the buffer: %q", got)
+	}
+	if !v.buf.synced_with_disk() {
+		t.Errorf("buffer is not in sync with disk after loading history")
+	}
+	for i := 0; i < 3; i++ {
+		v.undo()
+	}
+	if got := string(v.buf.contents()); got != original {
+		t.Errorf("undo produced %q, expected %q", got, original)
+	}
+	for i := 0; i < 3; i++ {
+		v.redo()
+	}
+	if got := string(v.buf.contents()); got != edited {
+		t.Errorf("redo produced %q, expected %q", got, edited)
+	}
+
+	// history doesn't apply to different contents and gets removed
+	if _, err := read_undo_file(path, contents_hash([]byte(original))); err == nil {
+		t.Errorf("history was loaded for different contents")
+	}
+	if _, err := os.Stat(undo_file_path(path)); !os.IsNotExist(err) {
+		t.Errorf("stale history file was not removed")
+	}
+}
+
+func TestSaveWithoutUndoHistory(t *testing.T) {
+	dir := t.TempDir()
+	// a file in place of the cache directory
+	cache := filepath.Join(dir, "cache")
+	ioutil.WriteFile(cache, nil, 0644)
+	t.Setenv("XDG_CACHE_HOME", cache)
+	path := filepath.Join(dir, "file.txt")
+
+	v := new_test_view("text\n")
+	v.action_insert(cursor_location{v.buf.first_line, 1, 0}, []byte("more "))
+	v.finalize_action_group()
+	err := v.buf.save_as(path)
+	if _, ok := err.(*undo_history_error); !ok {
+		t.Fatalf("save_as returned %v", err)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "more text\n" {
+		t.Errorf("file has %q", data)
+	}
+	if !v.buf.synced_with_disk() {
+		t.Errorf("buffer is not in sync with disk after the save")
+	}
+}
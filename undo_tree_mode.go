@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/nsf/termbox-go"
+)
+
+//----------------------------------------------------------------------------
+// undo tree mode
+//
+// Shows the history tree of the active buffer on top of the active view.
+// Moving the selection puts the buffer into the state of the selected node,
+// <enter> keeps it, C-g goes back to where it all started.
+//----------------------------------------------------------------------------
+
+const undo_tree_max_width = 60
+
+type undo_tree_node struct {
+	group  *action_group
+	indent int
+	label  []byte
+}
+
+type undo_tree_mode struct {
+	stub_overlay_mode
+	godit    *godit
+	view     *view
+	origin   *action_group
+	nodes    []undo_tree_node
+	selected int
+	top      int
+	accepted bool
+}
+
+func init_undo_tree_mode(godit *godit) *undo_tree_mode {
+	v := godit.active.leaf
+	v.finalize_action_group()
+	v.last_vcommand = vcommand_none
+
+	u := new(undo_tree_mode)
+	u.godit = godit
+	u.view = v
+	u.origin = v.buf.history
+
+	root := v.buf.history
+	for root.prev != nil {
+		root = root.prev
+	}
+	u.collect_nodes(root, 0)
+	for i, n := range u.nodes {
+		if n.group == u.origin {
+			u.selected = i
+		}
+	}
+	godit.set_status("(Undo tree: C-n/C-p to move, <enter> to accept, C-g to cancel)")
+	return u
+}
+
+// Pre-order traversal, every branch but the first one is indented one more
+// level than its parent, so that linear history stays linear.
+func (u *undo_tree_mode) collect_nodes(ag *action_group, indent int) {
+	u.nodes = append(u.nodes, undo_tree_node{
+		group:  ag,
+		indent: indent,
+		label:  undo_tree_label(ag),
+	})
+	for i, child := range ag.children {
+		if i == 0 {
+			u.collect_nodes(child, indent)
+		} else {
+			u.collect_nodes(child, indent+1)
+		}
+	}
+}
+
+func undo_tree_label(ag *action_group) []byte {
+	if ag.prev == nil {
+		return []byte("original")
+	}
+
+	var buf bytes.Buffer
+	if !ag.time.IsZero() {
+		buf.WriteString(ag.time.Format("Jan 02 15:04:05 "))
+	}
+	if len(ag.actions) > 0 {
+		a := &ag.actions[0]
+		if a.what == action_insert {
+			buf.WriteByte('+')
+		} else {
+			buf.WriteByte('-')
+		}
+		data := a.data
+		if len(data) > undo_tree_max_width {
+			data = data[:undo_tree_max_width]
+		}
+		buf.WriteString(strconv.Quote(string(data)))
+	}
+	if len(ag.actions) > 1 {
+		fmt.Fprintf(&buf, " (%d changes)", len(ag.actions))
+	}
+	return buf.Bytes()
+}
+
+func (u *undo_tree_mode) select_node(i int) {
+	if i < 0 || i >= len(u.nodes) {
+		return
+	}
+	u.selected = i
+	u.view.history_jump(u.nodes[i].group)
+	u.godit.set_status("(Undo tree: C-n/C-p to move, <enter> to accept, C-g to cancel)")
+}
+
+func (u *undo_tree_mode) exit() {
+	if !u.accepted {
+		u.view.history_jump(u.origin)
+		u.godit.set_status("(Undo tree browsing cancelled)")
+	}
+}
+
+func (u *undo_tree_mode) draw() {
+	g := u.godit
+	r := g.active.Rect
+	w := r.Width / 2
+	if w > undo_tree_max_width {
+		w = undo_tree_max_width
+	}
+	r.X += r.Width - w
+	r.Width = w
+	r.Height-- // leave the status bar of the view alone
+	if r.Width <= 0 || r.Height <= 0 {
+		return
+	}
+
+	if u.selected < u.top {
+		u.top = u.selected
+	}
+	if u.selected >= u.top+r.Height {
+		u.top = u.selected - r.Height + 1
+	}
+
+	lp := default_label_params
+	line := r
+	line.Height = 1
+	for i := 0; i < r.Height; i++ {
+		lp.Fg = termbox.ColorBlack
+		lp.Bg = termbox.ColorWhite
+		n := u.top + i
+		if n == u.selected {
+			lp.Fg = termbox.ColorWhite
+			lp.Bg = termbox.ColorBlue
+		}
+		g.uibuf.Fill(line, termbox.Cell{Fg: lp.Fg, Bg: lp.Bg, Ch: ' '})
+		if n < len(u.nodes) {
+			node := &u.nodes[n]
+			mark := "o "
+			if node.group == u.origin {
+				mark = "@ "
+			}
+			label := make([]byte, 0, 2*node.indent+len(mark)+len(node.label))
+			label = append(label, bytes.Repeat([]byte("  "), node.indent)...)
+			label = append(label, mark...)
+			label = append(label, node.label...)
+			g.uibuf.DrawLabel(line, &lp, label)
+		}
+		line.Y++
+	}
+}
+
+func (u *undo_tree_mode) on_key(ev *termbox.Event) {
+	g := u.godit
+	switch ev.Key {
+	case termbox.KeyCtrlN, termbox.KeyArrowDown:
+		u.select_node(u.selected + 1)
+	case termbox.KeyCtrlP, termbox.KeyArrowUp:
+		u.select_node(u.selected - 1)
+	case termbox.KeyEnter, termbox.KeyCtrlJ:
+		u.accepted = true
+		g.set_overlay_mode(nil)
+		g.set_status("Moved to another state in undo history")
+	default:
+		if ev.Ch == 'q' {
+			g.set_overlay_mode(nil)
+		}
+	}
+}
@@ -2,13 +2,14 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/nsf/tulib"
+	"io"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"unicode"
-	"unicode/utf8"
 )
 
 var invisible_rune_table = []rune{
@@ -79,6 +80,9 @@ func rune_advance_len(r rune, pos int) int {
 	case r < 32:
 		// for invisible chars like ^R ^@ and such, two cells
 		return 2
+	case is_invalid_rune(r):
+		// invalid bytes are shown as \xNN
+		return 4
 	}
 	return rune_width(r)
 }
@@ -86,7 +90,7 @@ func rune_advance_len(r rune, pos int) int {
 func vlen(data []byte, pos int) int {
 	origin := pos
 	for len(data) > 0 {
-		r, rlen := utf8.DecodeRune(data)
+		r, rlen := decode_rune(data)
 		data = data[rlen:]
 		pos += rune_advance_len(r, pos)
 	}
@@ -118,21 +122,21 @@ func iter_words(data []byte, cb func(word []byte)) {
 			return
 		}
 
-		r, rlen := utf8.DecodeRune(data)
+		r, rlen := decode_rune(data)
 		// skip non-word runes
 		for !is_word(r) {
 			data = data[rlen:]
 			if len(data) == 0 {
 				return
 			}
-			r, rlen = utf8.DecodeRune(data)
+			r, rlen = decode_rune(data)
 		}
 
 		// must be on a word rune
 		i := 0
 		for is_word(r) && i < len(data) {
 			i += rlen
-			r, rlen = utf8.DecodeRune(data[i:])
+			r, rlen = decode_rune(data[i:])
 		}
 		cb(data[:i])
 		data = data[i:]
@@ -145,21 +149,21 @@ func iter_words_backward(data []byte, cb func(word []byte)) {
 			return
 		}
 
-		r, rlen := utf8.DecodeLastRune(data)
+		r, rlen := decode_last_rune(data)
 		// skip non-word runes
 		for !is_word(r) {
 			data = data[:len(data)-rlen]
 			if len(data) == 0 {
 				return
 			}
-			r, rlen = utf8.DecodeLastRune(data)
+			r, rlen = decode_last_rune(data)
 		}
 
 		// must be on a word rune
 		i := len(data)
 		for is_word(r) && i > 0 {
 			i -= rlen
-			r, rlen = utf8.DecodeLastRune(data[:i])
+			r, rlen = decode_last_rune(data[:i])
 		}
 		cb(data[i:])
 		data = data[:i]
@@ -378,6 +382,16 @@ func substitute_home(path string) string {
 	return filepath.Join(home, path[1:])
 }
 
+// Returns a subdirectory of the editor's cache directory, the directory itself
+// may not exist yet.
+func cache_dir(name string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = substitute_home("~/.cache")
+	}
+	return filepath.Join(dir, "tam", name)
+}
+
 func substitute_symlinks(path string) string {
 	if path == "" {
 		return ""
@@ -393,6 +407,96 @@ func substitute_symlinks(path string) string {
 	return after
 }
 
+// Creates a new file with a unique name in 'dir', 'prefix' is prepended to the
+// name. Unlike ioutil.TempFile it lets the caller choose permissions, which
+// are then subject to umask as usual.
+func create_temp_file(dir, prefix string, perm os.FileMode) (*os.File, error) {
+	pid := strconv.Itoa(os.Getpid())
+	for i := 0; i < 10000; i++ {
+		name := filepath.Join(dir, prefix+pid+"-"+strconv.Itoa(i))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if os.IsExist(err) {
+			continue
+		}
+		return f, err
+	}
+	return nil, fmt.Errorf("too many temporary files named %s* in %s", prefix, dir)
+}
+
+// Follows the chain of symlinks starting at 'filename', the last target may
+// not exist yet (a dangling symlink), writing to it creates it then. Relative
+// targets are relative to the directory of the link.
+func symlink_target(filename string) string {
+	// the limit guards against symlink loops
+	for i := 0; i < 40; i++ {
+		fi, err := os.Lstat(filename)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			break
+		}
+		target, err := os.Readlink(filename)
+		if err != nil {
+			break
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(filename), target)
+		}
+		filename = target
+	}
+	return filename
+}
+
+// Writes 'data' to 'filename' without ever leaving it half-written: the data
+// goes to a temporary file in the same directory, which is synced and then
+// renamed over the original. If 'filename' is a symlink, the file it points
+// to is replaced. Permissions of an existing file are preserved.
+func atomic_write_file(filename string, data []byte) error {
+	filename = symlink_target(filename)
+
+	perm := os.FileMode(0666)
+	fi, err := os.Stat(filename)
+	exists := err == nil
+	if exists {
+		perm = fi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	}
+
+	dir := filepath.Dir(filename)
+	f, err := create_temp_file(dir, "."+filepath.Base(filename)+".tmp", perm)
+	if err != nil {
+		return err
+	}
+	tmpname := f.Name()
+
+	n, err := f.Write(data)
+	if err == nil && n < len(data) {
+		err = io.ErrShortWrite
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && exists {
+		// umask could have cut some bits off, restore them
+		err = os.Chmod(tmpname, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpname, filename)
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+
+	// make the rename itself durable, not every system allows that, hence
+	// errors are ignored
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
 func is_file_hidden(path string) bool {
 	if path == "." || path == ".." {
 		return true
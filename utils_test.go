@@ -0,0 +1,72 @@
+package main
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+
+func TestAtomicWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// permissions of the original file survive
+	name := filepath.Join(dir, "script.sh")
+	if err := ioutil.WriteFile(name, []byte("old"), 0751); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(name, 0751); err != nil {
+		t.Fatal(err)
+	}
+	if err := atomic_write_file(name, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0751 {
+		t.Errorf("mode is %v, expected %v", fi.Mode().Perm(), os.FileMode(0751))
+	}
+	if data, _ := ioutil.ReadFile(name); string(data) != "new" {
+		t.Errorf("contents are %q, expected %q", data, "new")
+	}
+
+	// writing through a symlink replaces the target and keeps the link
+	link := filepath.Join(dir, "link.sh")
+	if err := os.Symlink(name, link); err != nil {
+		t.Skip("symlinks are not supported:", err)
+	}
+	if err := atomic_write_file(link, []byte("newer")); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Lstat(link); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("symlink was replaced by a regular file")
+	}
+	if data, _ := ioutil.ReadFile(name); string(data) != "newer" {
+		t.Errorf("target contents are %q, expected %q", data, "newer")
+	}
+
+	// a dangling relative symlink gets its target created next to it
+	dangling := filepath.Join(dir, "dangling.txt")
+	if err := os.Symlink("new.txt", dangling); err != nil {
+		t.Fatal(err)
+	}
+	if err := atomic_write_file(dangling, []byte("created")); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Lstat(dangling); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("dangling symlink was replaced by a regular file")
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "new.txt")); string(data) != "created" {
+		t.Errorf("target contents are %q, expected %q", data, "created")
+	}
+
+	// no temporary files are left behind
+	names, _ := filepath.Glob(filepath.Join(dir, ".*"))
+	if len(names) != 0 {
+		t.Errorf("temporary files left: %v", names)
+	}
+}
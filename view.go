@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"regexp"
 	"strings"
+	"time"
 	"unicode/utf8"
 
 	termbox "github.com/nsf/termbox-go"
@@ -111,9 +113,11 @@ var default_view_tag = view_tag{
 //----------------------------------------------------------------------------
 
 type view_context struct {
-	set_status  func(format string, args ...interface{})
-	kill_buffer *[]byte
-	buffers     *[]*buffer
+	set_status func(format string, args ...interface{})
+	kill_ring  *kill_ring
+	buffers    *[]*buffer
+	jumps      *jump_list
+	registers  registers
 }
 
 //----------------------------------------------------------------------------
@@ -147,7 +151,24 @@ type view struct {
 	ac_decide        ac_decide_func
 	highlight_bytes  []byte
 	highlight_ranges []byte_range
+	highlight_regexp *regexp.Regexp
+	highlight_words  bool           // only whole word matches of 'highlight_regexp'
+	regexp_ranges    [][]byte_range // per visible line
 	tags             []view_tag
+
+	// hex view state for binary buffers: the first visible row, which
+	// nibble of the byte is edited, whether the ASCII column is active and
+	// whether typing inserts bytes instead of overwriting them
+	hex_top    int
+	hex_nibble int
+	hex_ascii  bool
+	hex_insert bool
+
+	// where the text inserted by the last yank starts
+	yank_start cursor_location
+
+	// extra cursors, see multi_cursor.go
+	cursors []extra_cursor
 }
 
 func new_view(ctx view_context, buf *buffer) *view {
@@ -185,6 +206,7 @@ func (v *view) attach(b *buffer) {
 	}
 
 	v.ac = nil
+	v.cursors = nil
 	if v.buf != nil {
 		v.detach()
 	}
@@ -260,6 +282,9 @@ func (v *view) draw_line(line *line, line_num, coff, line_voffset int) {
 
 	if len(v.highlight_bytes) > 0 {
 		v.find_highlight_ranges_for_line(data)
+	} else if v.highlight_regexp != nil {
+		v.highlight_ranges = append(v.highlight_ranges[:0],
+			v.regexp_ranges_for(line_num)...)
 	}
 	for {
 		rx := x - line_voffset
@@ -267,7 +292,7 @@ func (v *view) draw_line(line *line, line_num, coff, line_voffset int) {
 			break
 		}
 
-		if x == tabstop {
+		for x >= tabstop {
 			tabstop += tabstop_length
 		}
 
@@ -281,7 +306,7 @@ func (v *view) draw_line(line *line, line_num, coff, line_voffset int) {
 			break
 		}
 
-		r, rlen := utf8.DecodeRune(data)
+		r, rlen := decode_rune(data)
 		switch {
 		case r == '\t':
 			// fill with spaces to the next tabstop
@@ -318,6 +343,24 @@ func (v *view) draw_line(line *line, line_num, coff, line_voffset int) {
 				}
 			}
 			x++
+		case is_invalid_rune(r):
+			// bytes which are not valid UTF-8 like \xFF
+			b := byte(r - invalid_rune_base)
+			hex := [4]rune{'\\', 'x', rune(hex_digits[b>>4]), rune(hex_digits[b&15])}
+			for _, hr := range hex {
+				rx = x - line_voffset
+				if rx >= v.uibuf.Width {
+					break
+				}
+				if rx >= 0 {
+					v.uibuf.Cells[coff+rx] = termbox.Cell{
+						Ch: hr,
+						Fg: termbox.ColorRed,
+						Bg: termbox.ColorDefault,
+					}
+				}
+				x++
+			}
 		default:
 			if rx >= 0 {
 				v.uibuf.Cells[coff+rx] = v.make_cell(
@@ -354,6 +397,15 @@ func (v *view) draw_contents() {
 		return
 	}
 
+	if v.buf.is_binary() {
+		v.draw_hex()
+		return
+	}
+
+	if v.highlight_regexp != nil {
+		v.find_regexp_ranges()
+	}
+
 	// draw lines
 	line := v.top_line
 	coff := 0
@@ -372,6 +424,7 @@ func (v *view) draw_contents() {
 		coff += v.uibuf.Width
 		line = line.next
 	}
+	v.draw_extra_cursors()
 }
 
 func (v *view) draw_status() {
@@ -401,7 +454,11 @@ func (v *view) draw_status() {
 	// line
 	lp.Fg = 237
 	lp.Bg = 247
-	fmt.Fprintf(&v.tmpbuf, " %d:%d ", v.cursor.line_num, v.cursor_voffset)
+	if v.buf.is_binary() {
+		fmt.Fprintf(&v.tmpbuf, " 0x%X ", v.hex_offset())
+	} else {
+		fmt.Fprintf(&v.tmpbuf, " %d:%d ", v.cursor.line_num, v.cursor_voffset)
+	}
 	v.uibuf.DrawLabel(tulib.Rect{1, v.height(), v.uibuf.Width, 1},
 		&lp, v.tmpbuf.Bytes())
 	linel := v.tmpbuf.Len()
@@ -410,7 +467,14 @@ func (v *view) draw_status() {
 	// filename
 	lp.Fg = 255
 	lp.Bg = 237
-	fmt.Fprintf(&v.tmpbuf, " %s", v.buf.name)
+	fmt.Fprintf(&v.tmpbuf, " %s (", v.buf.name)
+	if v.buf.codec != codec_none {
+		fmt.Fprintf(&v.tmpbuf, "%s, ", v.buf.codec)
+	}
+	fmt.Fprintf(&v.tmpbuf, "%s, %s)", v.buf.encoding, eol_name(v.buf.eol))
+	if v.buf.history_truncated {
+		v.tmpbuf.WriteString(" [undo truncated]")
+	}
 	v.uibuf.DrawLabel(tulib.Rect{1+linel, v.height(), v.uibuf.Width, 1},
 		&lp, v.tmpbuf.Bytes())
 	v.tmpbuf.Reset()
@@ -561,6 +625,9 @@ func (v *view) adjust_line_voffset() {
 }
 
 func (v *view) cursor_position() (int, int) {
+	if v.buf.is_binary() {
+		return v.hex_cursor_position()
+	}
 	y := v.cursor.line_num - v.top_line_num
 	x := v.cursor_voffset - v.line_voffset
 	return x, y
@@ -751,12 +818,21 @@ func (v *view) maybe_next_action_group() {
 		return
 	}
 
-	prev := b.history
-	b.history = b.history.next
-	b.history.prev = prev
-	b.history.next = nil
-	b.history.actions = nil
-	b.history.before = v.cursor
+	next := b.history.next
+	if len(next.actions) != 0 {
+		// there is something to redo, instead of throwing it away,
+		// start a new branch next to it
+		next = new(action_group)
+	}
+	next.prev = b.history
+	next.next = nil
+	next.actions = nil
+	next.before = v.cursor
+	next.time = time.Now()
+	b.history.children = append(b.history.children, next)
+	b.history.next = next
+	b.history = next
+	b.history_size += action_group_memory_cost
 }
 
 func (v *view) finalize_action_group() {
@@ -767,6 +843,12 @@ func (v *view) finalize_action_group() {
 	if b.history.next == nil {
 		b.history.next = new(action_group)
 		b.history.after = v.cursor
+		if b.trim_history() {
+			v.ctx.set_status("Undo history exceeded %d MB, oldest changes were dropped", b.undo_limit>>20)
+			for _, bv := range b.views {
+				bv.dirty |= dirty_status
+			}
+		}
 	}
 }
 
@@ -774,7 +856,11 @@ func (v *view) undo() {
 	b := v.buf
 	if b.history.prev == nil {
 		// we're at the sentinel, no more things to undo
-		v.ctx.set_status("No further undo information")
+		if b.history_truncated {
+			v.ctx.set_status("No further undo information (older history was dropped)")
+		} else {
+			v.ctx.set_status("No further undo information")
+		}
 		return
 	}
 
@@ -818,6 +904,37 @@ func (v *view) redo() {
 	v.ctx.set_status("Redo!")
 }
 
+// Moves the buffer to the state right after the 'target' group, undoing and
+// redoing groups on the way from the current one through their closest common
+// ancestor in the history tree.
+func (v *view) history_jump(target *action_group) {
+	b := v.buf
+	v.finalize_action_group()
+
+	ancestors := make(map[*action_group]bool)
+	for ag := b.history; ag != nil; ag = ag.prev {
+		ancestors[ag] = true
+	}
+	var path []*action_group
+	common := target
+	for !ancestors[common] {
+		if common == nil {
+			// not in this history (it was trimmed or replaced)
+			return
+		}
+		path = append(path, common)
+		common = common.prev
+	}
+
+	for b.history != common {
+		v.undo()
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		b.history.next = path[i]
+		v.redo()
+	}
+}
+
 func (v *view) action_insert(c cursor_location, data []byte) {
 	if v.oneline {
 		data = bytes.Replace(data, []byte{'\n'}, nil, -1)
@@ -835,6 +952,7 @@ func (v *view) action_insert(c cursor_location, data []byte) {
 	}
 	a.apply(v)
 	v.buf.history.append(&a)
+	v.buf.history_size += a.memory_cost()
 }
 
 func (v *view) action_delete(c cursor_location, nbytes int) {
@@ -852,6 +970,7 @@ func (v *view) action_delete(c cursor_location, nbytes int) {
 	}
 	a.apply(v)
 	v.buf.history.append(&a)
+	v.buf.history_size += a.memory_cost()
 }
 
 // Insert a rune 'r' at the current cursor position, advance cursor one character forward.
@@ -992,7 +1111,7 @@ func (v *view) kill_region() {
 }
 
 func (v *view) set_mark() {
-	v.buf.mark = v.cursor
+	v.buf.push_mark(v.cursor)
 	v.ctx.set_status("Mark set")
 }
 
@@ -1089,11 +1208,25 @@ func (v *view) on_delete(a *action) {
 }
 
 func (v *view) on_vcommand(cmd vcommand, arg rune) {
+	if v.buf.readonly && cmd.modifies_buffer() {
+		v.ctx.set_status("%s", err_readonly_buffer)
+		return
+	}
+
 	last_class := v.last_vcommand.class()
 	if cmd.class() != last_class || last_class == vcommand_class_misc {
 		v.finalize_action_group()
 	}
 
+	yank := v.ctx.kill_ring.yank
+	v.run_vcommand(cmd, arg)
+	if len(v.cursors) != 0 && cmd.at_every_cursor() {
+		v.run_at_extra_cursors(cmd, arg, yank)
+	}
+	v.last_vcommand = cmd
+}
+
+func (v *view) run_vcommand(cmd vcommand, arg rune) {
 	switch cmd {
 	case vcommand_move_cursor_forward:
 		v.move_cursor_forward()
@@ -1131,6 +1264,8 @@ func (v *view) on_vcommand(cmd vcommand, arg rune) {
 		v.insert_rune(arg)
 	case vcommand_yank:
 		v.yank()
+	case vcommand_yank_pop:
+		v.yank_pop()
 	case vcommand_delete_rune_backward:
 		v.delete_rune_backward()
 	case vcommand_delete_rune:
@@ -1175,11 +1310,14 @@ func (v *view) on_vcommand(cmd vcommand, arg rune) {
 	case vcommand_word_to_lower:
 		v.word_to(bytes.ToLower)
 	}
-
-	v.last_vcommand = cmd
 }
 
 func (v *view) on_key(ev *termbox.Event) {
+	if v.buf.is_binary() {
+		v.hex_on_key(ev)
+		return
+	}
+
 	switch ev.Key {
 	case termbox.KeyCtrlF, termbox.KeyArrowRight:
 		v.on_vcommand(vcommand_move_cursor_forward, 0)
@@ -1245,8 +1383,10 @@ func (v *view) on_key(ev *termbox.Event) {
 		case 'v':
 			v.on_vcommand(vcommand_move_view_half_backward, 0)
 		case '<':
+			v.push_jump()
 			v.on_vcommand(vcommand_move_cursor_beginning_of_file, 0)
 		case '>':
+			v.push_jump()
 			v.on_vcommand(vcommand_move_cursor_end_of_file, 0)
 		case 'f':
 			v.on_vcommand(vcommand_move_cursor_word_forward, 0)
@@ -1413,7 +1553,7 @@ func (v *view) ensure_trailing_eol() {
 func (v *view) presave_cleanup(raw bool) {
 	v.finalize_action_group()
 	v.last_vcommand = vcommand_none
-	if !raw {
+	if !raw && !v.buf.is_binary() {
 		v.cleanup_trailing_whitespaces()
 		v.cleanup_trailing_newlines()
 		v.ensure_trailing_eol()
@@ -1421,43 +1561,24 @@ func (v *view) presave_cleanup(raw bool) {
 	}
 }
 
-func (v *view) append_to_kill_buffer(cursor cursor_location, nbytes int) {
-	kb := *v.ctx.kill_buffer
+// Replace the whole contents of the buffer with 'data' as a single action
+// group, the cursor stays on the same line if possible.
+func (v *view) replace_contents(data []byte) {
+	v.finalize_action_group()
+	v.last_vcommand = vcommand_none
 
-	switch v.last_vcommand {
-	case vcommand_kill_word, vcommand_kill_word_backward, vcommand_kill_region, vcommand_kill_line:
-	default:
-		kb = kb[:0]
+	line_num := v.cursor.line_num
+	beg := cursor_location{v.buf.first_line, 1, 0}
+	end := cursor_location{v.buf.last_line, v.buf.lines_n, len(v.buf.last_line.data)}
+	if d := beg.distance(end); d > 0 {
+		v.action_delete(beg, d)
 	}
-
-	kb = append(kb, cursor.extract_bytes(nbytes)...)
-	*v.ctx.kill_buffer = kb
-}
-
-func (v *view) prepend_to_kill_buffer(cursor cursor_location, nbytes int) {
-	kb := *v.ctx.kill_buffer
-
-	switch v.last_vcommand {
-	case vcommand_kill_word, vcommand_kill_word_backward, vcommand_kill_region, vcommand_kill_line:
-	default:
-		kb = kb[:0]
+	v.move_cursor_to(beg)
+	if len(data) > 0 {
+		v.action_insert(beg, data)
 	}
-
-	kb = append(cursor.extract_bytes(nbytes), kb...)
-	*v.ctx.kill_buffer = kb
-}
-
-func (v *view) yank() {
-	buf := *v.ctx.kill_buffer
-	cursor := v.cursor
-
-	if len(buf) == 0 {
-		return
-	}
-	cbuf := clone_byte_slice(buf)
-	v.action_insert(cursor, cbuf)
-	cursor.move_n_bytes_forward(buf)
-	v.move_cursor_to(cursor)
+	v.finalize_action_group()
+	v.move_cursor_to_line(line_num)
 }
 
 // shameless copy & paste from kill_region
@@ -1574,10 +1695,23 @@ func (v *view) word_to(filter func([]byte) []byte) {
 	v.move_cursor_to(c1)
 }
 
+// Edits made outside of 'on_vcommand' go through 'filter_text' or
+// 'search_and_replace', so these check for read-only buffers themselves.
+func (v *view) check_writable() bool {
+	if v.buf.readonly {
+		v.ctx.set_status("%s", err_readonly_buffer)
+		return false
+	}
+	return true
+}
+
 // Filter _must_ return a new slice and shouldn't touch contents of the
 // argument, perfect filter examples are: bytes.Title, bytes.ToUpper,
 // bytes.ToLower
 func (v *view) filter_text(from, to cursor_location, filter func([]byte) []byte) {
+	if !v.check_writable() {
+		return
+	}
 	c1, c2 := swap_cursors_maybe(from, to)
 	d := c1.distance(c2)
 	v.action_delete(c1, d)
@@ -1639,7 +1773,7 @@ func fill_region_filt(data []byte, maxv int, prefix []byte) []byte {
 		lastspacei := -1
 		i := 0
 		for i < len(data) {
-			r, rlen := utf8.DecodeRune(data[i:])
+			r, rlen := decode_rune(data[i:])
 			if r == ' ' {
 				// if the rune is a space and we still haven't found one
 				// or we're still before maxv, update the index of the
@@ -1731,7 +1865,12 @@ func (v *view) collect_words(slice [][]byte, dups *llrb_tree, ignorecase bool) [
 	return slice
 }
 
-func (v *view) search_and_replace(word, repl []byte) {
+// Replaces 'word' with 'repl' in the region. When the case is ignored, the
+// replacement follows the case of each match (see 'preserve_case').
+func (v *view) search_and_replace(word, repl []byte, opts search_options) {
+	if !v.check_writable() {
+		return
+	}
 	// assumes mark is set
 	c1, c2 := swap_cursors_maybe(v.cursor, v.buf.mark)
 	cur := cursor_location{
@@ -1739,6 +1878,11 @@ func (v *view) search_and_replace(word, repl []byte) {
 		line_num: c1.line_num,
 		boffset:  c1.boffset,
 	}
+	fold := opts.folds(word, false)
+	var re *regexp.Regexp
+	if !opts.plain(word) {
+		re, _ = opts.compile(word, false)
+	}
 	for {
 		var end int
 		if cur.line == c2.line {
@@ -1747,32 +1891,36 @@ func (v *view) search_and_replace(word, repl []byte) {
 			end = len(cur.line.data)
 		}
 
-		i := bytes.Index(cur.line.data[cur.boffset:end], word)
+		i, n := find_replaced_word(cur.line.data, cur.boffset, end, word, re, opts.whole_word)
 		if i != -1 {
 			// match on this line, replace it
-			cur.boffset += i
-			v.action_delete(cur, len(word))
+			cur.boffset = i
+			r := repl
+			if fold {
+				r = preserve_case(cur.line.data[i:i+n], repl)
+			}
+			v.action_delete(cur, n)
 
 			// It is safe to use the original 'repl' here, but be
 			// very careful with that, it may change. 'repl' comes
 			// from 'godit.s_and_r_last_repl', if someone decides
 			// to make it mutable, then 'repl' must be copied
 			// somewhere in this func.
-			v.action_insert(cur, repl)
+			v.action_insert(cur, r)
 
 			// special correction if we're on the same line as 'c2'
 			if cur.line == c2.line {
-				c2.boffset += len(repl) - len(word)
+				c2.boffset += len(r) - n
 			}
 
 			if cur.line == v.cursor.line && cur.boffset < v.cursor.boffset {
 				c := v.cursor
-				c.boffset += len(repl) - len(word)
+				c.boffset += len(r) - n
 				v.move_cursor_to(c)
 			}
 
 			// continue with the same line
-			cur.boffset += len(repl)
+			cur.boffset += len(r)
 			continue
 		}
 
@@ -1789,6 +1937,31 @@ func (v *view) search_and_replace(word, repl []byte) {
 	v.ctx.set_status("Replaced %s with %s", word, repl)
 }
 
+// Returns the offset and the length of the first match of 'word' in
+// data[from:to], or -1. 're' is used instead of 'word' when it's set.
+func find_replaced_word(data []byte, from, to int, word []byte, re *regexp.Regexp, whole_word bool) (int, int) {
+	if re == nil {
+		i := bytes.Index(data[from:to], word)
+		if i == -1 {
+			return -1, 0
+		}
+		return from + i, len(word)
+	}
+	for from <= to {
+		m := re.FindIndex(data[from:to])
+		if m == nil {
+			break
+		}
+		beg, end := from+m[0], from+m[1]
+		if !whole_word || is_whole_word_match(data, beg, end) {
+			return beg, end - beg
+		}
+		_, rlen := decode_rune(data[beg:])
+		from = beg + rlen
+	}
+	return -1, 0
+}
+
 func (v *view) other_buffers(cb func(buf *buffer)) {
 	bufs := *v.ctx.buffers
 	for _, buf := range bufs {
@@ -1866,6 +2039,7 @@ const (
 	vcommand_indent_region
 	vcommand_deindent_region
 	vcommand_copy_region
+	vcommand_yank_pop
 	vcommand_region_to_upper
 	vcommand_region_to_lower
 	vcommand_word_to_upper
@@ -1893,3 +2067,18 @@ func (c vcommand) class() vcommand_class {
 	}
 	return vcommand_class_none
 }
+
+func (c vcommand) modifies_buffer() bool {
+	switch c {
+	case vcommand_copy_region,
+		vcommand_autocompl_move_cursor_up,
+		vcommand_autocompl_move_cursor_down:
+		return false
+	}
+	switch c.class() {
+	case vcommand_class_insertion, vcommand_class_deletion,
+		vcommand_class_history, vcommand_class_misc:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,290 @@
+package main
+
+import "strings"
+import "testing"
+import termbox "github.com/nsf/termbox-go"
+
+func new_test_view(contents string) *view {
+	buf, _ := new_buffer(strings.NewReader(contents))
+	ctx := view_context{
+		set_status: func(string, ...interface{}) {},
+		kill_ring:  new(kill_ring),
+		buffers:    &[]*buffer{buf},
+	}
+	return new_view(ctx, buf)
+}
+
+func TestUndoTree(t *testing.T) {
+	v := new_test_view("hello\n")
+	insert := func(s string) {
+		c := v.cursor
+		c.move_end_of_line()
+		v.action_insert(c, []byte(s))
+		c.boffset += len(s)
+		v.move_cursor_to(c)
+		v.finalize_action_group()
+	}
+	insert(" world")
+	insert("!")
+	first_branch := v.buf.history
+
+	// undo and type something else, the redo branch must survive
+	v.undo()
+	insert("?")
+	if got := string(v.buf.contents()); got != "hello world?\n" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+	parent := v.buf.history.prev
+	if len(parent.children) != 2 || parent.children[0] != first_branch {
+		t.Fatalf("old branch was lost, %d children", len(parent.children))
+	}
+
+	v.history_jump(first_branch)
+	if got := string(v.buf.contents()); got != "hello world!\n" {
+		t.Errorf("jump to the old branch produced %q", got)
+	}
+	v.history_jump(parent.prev)
+	if got := string(v.buf.contents()); got != "hello\n" {
+		t.Errorf("jump to the root produced %q", got)
+	}
+
+	// redo follows the most recently visited branch
+	v.redo()
+	v.redo()
+	if got := string(v.buf.contents()); got != "hello world!\n" {
+		t.Errorf("redo produced %q", got)
+	}
+
+	// a group from another history leaves the buffer alone
+	other := new_test_view("other\n")
+	other.action_insert(other.cursor, []byte("x"))
+	other.finalize_action_group()
+	v.history_jump(other.buf.history)
+	if got := string(v.buf.contents()); got != "hello world!\n" {
+		t.Errorf("jump out of the history produced %q", got)
+	}
+}
+
+func TestUndoLimit(t *testing.T) {
+	v := new_test_view("")
+	insert := func(s string) {
+		c := v.cursor
+		v.action_insert(c, []byte(s))
+		c.boffset += len(s)
+		v.move_cursor_to(c)
+		v.finalize_action_group()
+	}
+	history_size := func() int {
+		root := v.buf.history
+		for root.prev != nil {
+			root = root.prev
+		}
+		size := 0
+		var walk func(ag *action_group)
+		walk = func(ag *action_group) {
+			size += ag.memory_cost()
+			for _, child := range ag.children {
+				walk(child)
+			}
+		}
+		for _, child := range root.children {
+			walk(child)
+		}
+		return size
+	}
+
+	// a side branch, which is older than anything on the main one
+	insert("a")
+	v.undo()
+	insert("b")
+	side := v.buf.history.prev.children[0]
+	v.buf.undo_limit = 10 * (action_group_memory_cost + 1)
+	for i := 0; i < 8; i++ {
+		insert("c")
+	}
+	if v.buf.history_truncated || len(v.buf.history.prev.children) == 0 {
+		t.Fatalf("history was truncated too early")
+	}
+	insert("d")
+	if !v.buf.history_truncated {
+		t.Fatalf("history was not truncated")
+	}
+	if side.prev.children[0] == side {
+		t.Errorf("side branch was not dropped first")
+	}
+	for i := 0; i < 10; i++ {
+		insert("e")
+	}
+	if v.buf.history_size != history_size() || v.buf.history_size > v.buf.undo_limit {
+		t.Errorf("history size is %d, expected %d within %d",
+			v.buf.history_size, history_size(), v.buf.undo_limit)
+	}
+	if v.buf.on_disk != nil {
+		t.Errorf("dropped saved state is still referenced")
+	}
+
+	expected := string(v.buf.contents())
+	n := 0
+	for v.buf.history.prev != nil {
+		v.undo()
+		n++
+	}
+	oldest := string(v.buf.contents())
+	for i := 0; i < n; i++ {
+		v.redo()
+	}
+	if got := string(v.buf.contents()); got != expected {
+		t.Errorf("redo after truncation produced %q, expected %q", got, expected)
+	}
+	if oldest == "" || !strings.HasPrefix(expected, oldest) {
+		t.Errorf("unexpected oldest state %q", oldest)
+	}
+}
+
+func TestHexView(t *testing.T) {
+	original := "\x00\x01 \n\t\r\n"
+	v := new_test_view(original)
+	if !v.buf.is_binary() {
+		t.Fatalf("binary data detected as %s", v.buf.encoding)
+	}
+	if v.buf.bytes_n != len(original) {
+		t.Fatalf("buffer size is %d, expected %d", v.buf.bytes_n, len(original))
+	}
+	typed := func(keys string) {
+		for _, ch := range keys {
+			v.hex_on_key(&termbox.Event{Ch: ch})
+		}
+	}
+
+	// overwrite the second and the third byte, the latter with a newline
+	v.hex_move_to(1)
+	typed("ff0a")
+	if got := string(v.buf.contents()); got != "\x00\xff\n\n\t\r\n" {
+		t.Errorf("overwriting produced %q", got)
+	}
+	if v.hex_offset() != 3 {
+		t.Errorf("cursor is at %d after typing two bytes", v.hex_offset())
+	}
+
+	// both nibbles of a byte are undone together
+	v.undo()
+	if got := string(v.buf.contents()); got != "\x00\xff \n\t\r\n" {
+		t.Errorf("undoing a typed byte produced %q", got)
+	}
+	v.redo()
+
+	// insert at the end, then delete the first byte
+	v.hex_insert = true
+	v.hex_move_to(v.buf.bytes_n)
+	typed("41")
+	v.hex_move_to(0)
+	v.hex_on_key(&termbox.Event{Key: termbox.KeyDelete})
+	expected := "\xff\n\n\t\r\nA"
+	if got := string(v.buf.contents()); got != expected {
+		t.Errorf("editing produced %q, expected %q", got, expected)
+	}
+
+	// no cleanup for binary data
+	v.presave_cleanup(false)
+	if data, _ := v.buf.file_contents(); string(data) != expected {
+		t.Errorf("file contents are %q, expected %q", data, expected)
+	}
+
+	for v.buf.history.prev != nil {
+		v.undo()
+	}
+	if got := string(v.buf.contents()); got != original {
+		t.Errorf("undo produced %q", got)
+	}
+}
+
+func TestMarkRingAndJumps(t *testing.T) {
+	v := new_test_view("one\ntwo\nthree\nfour\n")
+	jumps := new(jump_list)
+	v.ctx.jumps = jumps
+	goto_line := func(n int) {
+		v.move_cursor_to(v.buf.location_at(n, 0))
+	}
+
+	for _, n := range []int{1, 2, 3} {
+		goto_line(n)
+		v.set_mark()
+	}
+	goto_line(4)
+	for _, want := range []int{3, 2, 1, 3} {
+		v.pop_mark()
+		if v.cursor.line_num != want {
+			t.Fatalf("popped mark at line %d, want %d", v.cursor.line_num, want)
+		}
+	}
+
+	// jumps from lines 2 and 3, then insert a line above them
+	goto_line(2)
+	v.push_jump()
+	goto_line(3)
+	v.push_jump()
+	goto_line(4)
+	v.action_insert(v.buf.location_at(1, 0), []byte("zero\n"))
+	v.finalize_action_group()
+	goto_line(5)
+
+	for _, want := range []int{4, 3} {
+		j, ok := jumps.back(v.buf, v.cursor)
+		if !ok || j.loc.line_num != want {
+			t.Fatalf("jumped back to line %d, want %d", j.loc.line_num, want)
+		}
+	}
+	if _, ok := jumps.back(v.buf, v.cursor); ok {
+		t.Fatal("jumped back past the first entry")
+	}
+	for _, want := range []int{4, 5} {
+		j, ok := jumps.forward()
+		if !ok || j.loc.line_num != want {
+			t.Fatalf("jumped forward to line %d, want %d", j.loc.line_num, want)
+		}
+	}
+	if _, ok := jumps.forward(); ok {
+		t.Fatal("jumped forward past the last entry")
+	}
+}
+
+func TestKillRing(t *testing.T) {
+	v := new_test_view("one two three\n")
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			v.on_vcommand(vcommand_move_cursor_forward, 0)
+		}
+		v.on_vcommand(vcommand_kill_word, 0)
+	}
+	if got := len(v.ctx.kill_ring.entries); got != 3 {
+		t.Fatalf("kill ring has %d entries, want 3", got)
+	}
+
+	v.on_vcommand(vcommand_yank, 0)
+	for _, want := range []string{"three", "two", "one", "three"} {
+		if got := string(v.buf.contents()); got != "  "+want+"\n" {
+			t.Fatalf("yanked %q, want %q", got, "  "+want+"\n")
+		}
+		v.on_vcommand(vcommand_yank_pop, 0)
+	}
+
+	// consecutive kills go into one entry
+	v = new_test_view("one two three\n")
+	v.on_vcommand(vcommand_kill_word, 0)
+	v.on_vcommand(vcommand_kill_word, 0)
+	if got := string(v.ctx.kill_ring.head()); got != "one two" {
+		t.Fatalf("kill ring head is %q, want \"one two\"", got)
+	}
+}
+
+func TestReadonlyEdits(t *testing.T) {
+	v := new_test_view("foo bar foo\n")
+	v.buf.readonly = true
+	v.buf.mark = v.cursor
+	v.move_cursor_to(cursor_location{v.buf.first_line, 1, len(v.buf.first_line.data)})
+	v.search_and_replace([]byte("foo"), []byte("baz"), search_options{})
+	v.fill_region(4, nil)
+	if got := string(v.buf.contents()); got != "foo bar foo\n" {
+		t.Errorf("read-only buffer was changed to %q", got)
+	}
+}